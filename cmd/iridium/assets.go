@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// An inliner follows the assets referenced by passages and by game.html,
+// including the fonts and images of local stylesheets, and records the
+// files they use. References to missing files are errors.
+//
+// When inlining, for build --single-file, assets become data URIs and
+// local stylesheets are copied into the page, so that the game plays from
+// a single file. External URLs cannot be inlined; they are left as they
+// are, with a warning.
+
+type inliner struct {
+	srcdir string
+	inline bool
+	errors []string
+	// Files used, relative to srcdir.
+	used map[string]bool
+	// External URLs already warned about.
+	warned map[string]bool
+}
+
+func newInliner(srcdir string, inline bool) *inliner {
+	return &inliner{srcdir: srcdir, inline: inline, used: make(map[string]bool), warned: make(map[string]bool)}
+}
+
+// use records that file is used, and reports whether it exists.
+func (in *inliner) use(file string, ref string, where string) bool {
+	if _, err := os.Stat(file); err != nil {
+		in.errors = append(in.errors, fmt.Sprintf("%s: missing asset %s", where, ref))
+		return false
+	}
+	if rel, err := filepath.Rel(in.srcdir, file); err == nil {
+		in.used[filepath.ToSlash(rel)] = true
+	}
+	return true
+}
+
+func (in *inliner) warnExternal(ref string, where string) {
+	if in.inline && !in.warned[ref] {
+		in.warned[ref] = true
+		fmt.Printf("warning: %s: external URL %s is not inlined\n", where, ref)
+	}
+}
+
+func isExternal(ref string) bool {
+	return strings.Contains(ref, "://") || strings.HasPrefix(ref, "//")
+}
+
+// assetFile is the file an asset reference from dir points to, or "" for
+// references that are not to files: URLs, data URIs and fragments. Any
+// query or fragment, used to bust caches, is dropped.
+func assetFile(dir string, ref string) string {
+	if ref == "" || strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") || isExternal(ref) {
+		return ""
+	}
+	return path.Join(dir, strings.SplitN(strings.SplitN(ref, "?", 2)[0], "#", 2)[0])
+}
+
+// dataURI reads a file referenced from dir into a data URI, when
+// inlining.
+func (in *inliner) dataURI(dir string, ref string, where string) string {
+	if isExternal(ref) {
+		in.warnExternal(ref, where)
+		return ref
+	}
+	file := assetFile(dir, ref)
+	if file == "" || !in.use(file, ref, where) || !in.inline {
+		return ref
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		in.errors = append(in.errors, fmt.Sprintf("%s: %s", where, err))
+		return ref
+	}
+	mimeType := mime.TypeByExtension(path.Ext(file))
+	if mimeType == "" {
+		mimeType = audioTypes[strings.ToLower(path.Ext(file))]
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(content)
+	}
+	// Parameters such as charset= would need escaping in a data URI.
+	mimeType = strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(content))
+}
+
+// Audio types, which systems often do not know.
+var audioTypes = map[string]string{
+	".ogg": "audio/ogg",
+	".oga": "audio/ogg",
+	".opus": "audio/ogg",
+	".mp3": "audio/mpeg",
+	".m4a": "audio/mp4",
+	".wav": "audio/wav",
+	".flac": "audio/flac",
+}
+
+// asset follows an asset referenced in a passage file. Passages give
+// paths, which check reads as files, so they become URLs to those files.
+func (in *inliner) asset(ref string, file string) string {
+	uri := in.dataURI(in.srcdir, ref, file)
+	if uri != ref || assetFile(in.srcdir, ref) == "" {
+		return uri
+	}
+	return pathURL(ref)
+}
+
+// pathURL escapes each segment of the path of a reference, leaving any
+// query or fragment as it is.
+func pathURL(ref string) string {
+	end := strings.IndexAny(ref, "?#")
+	if end < 0 {
+		end = len(ref)
+	}
+	segments := strings.Split(ref[:end], "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return strings.Join(segments, "/") + ref[end:]
+}
+
+var cssURL = regexp.MustCompile(`url\(\s*(["']?)([^"')]*)(["']?)\s*\)`)
+var cssImport = regexp.MustCompile(`@import\s+(?:url\()?\s*["']?([^"');]*)["']?\s*\)?[^;]*;`)
+
+// css inlines the imports, fonts and images of a stylesheet in dir.
+func (in *inliner) css(css string, dir string, where string) string {
+	css = cssImport.ReplaceAllStringFunc(css, func(rule string) string {
+		ref := cssImport.FindStringSubmatch(rule)[1]
+		if isExternal(ref) {
+			in.warnExternal(ref, where)
+			return rule
+		}
+		file := path.Join(dir, ref)
+		if !in.use(file, ref, where) {
+			return rule
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			in.errors = append(in.errors, fmt.Sprintf("%s: %s", where, err))
+			return rule
+		}
+		css := in.css(string(content), path.Dir(file), file)
+		if !in.inline {
+			return rule
+		}
+		return css
+	})
+	return cssURL.ReplaceAllStringFunc(css, func(u string) string {
+		m := cssURL.FindStringSubmatch(u)
+		return "url(" + m[1] + in.dataURI(dir, m[2], where) + m[3] + ")"
+	})
+}
+
+var htmlLink = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+var htmlStyle = regexp.MustCompile(`(?is)(<style\b[^>]*>)(.*?)(</style>)`)
+var htmlSrc = regexp.MustCompile(`(?is)(<[a-z][^>]*?\s(?:src|poster)\s*=\s*)(["'])([^"']*)(["'])`)
+var linkHref = regexp.MustCompile(`(?is)(\shref\s*=\s*)(["'])([^"']*)(["'])`)
+var linkRel = regexp.MustCompile(`(?is)\srel\s*=\s*["']?([^"'>]*)`)
+
+// html inlines what the game.html template references.
+func (in *inliner) html(page string) string {
+	page = htmlLink.ReplaceAllStringFunc(page, func(tag string) string {
+		href := linkHref.FindStringSubmatch(tag)
+		if href == nil {
+			return tag
+		}
+		rel := linkRel.FindStringSubmatch(tag)
+		if rel != nil && strings.Contains(strings.ToLower(rel[1]), "stylesheet") && !isExternal(href[3]) {
+			file := path.Join(in.srcdir, href[3])
+			if !in.use(file, href[3], SRC_HTML) {
+				return tag
+			}
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				in.errors = append(in.errors, fmt.Sprintf("%s: %s", SRC_HTML, err))
+				return tag
+			}
+			css := in.css(string(content), path.Dir(file), file)
+			if !in.inline {
+				return tag
+			}
+			return "<style>\n" + css + "\n</style>"
+		}
+		return strings.Replace(tag, href[0], href[1] + href[2] + in.dataURI(in.srcdir, href[3], SRC_HTML) + href[4], 1)
+	})
+	page = htmlStyle.ReplaceAllStringFunc(page, func(style string) string {
+		m := htmlStyle.FindStringSubmatch(style)
+		return m[1] + in.css(m[2], in.srcdir, SRC_HTML) + m[3]
+	})
+	return htmlSrc.ReplaceAllStringFunc(page, func(attr string) string {
+		m := htmlSrc.FindStringSubmatch(attr)
+		return m[1] + m[2] + in.dataURI(in.srcdir, m[3], SRC_HTML) + m[4]
+	})
+}
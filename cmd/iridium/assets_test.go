@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPathURL(t *testing.T) {
+	tests := []struct {
+		ref string
+		want string
+	}{
+		{"assets/a.png", "assets/a.png"},
+		{"assets/it's a \\ picture.png", "assets/it%27s%20a%20%5C%20picture.png"},
+		{"assets/a b.png?v=2 3#x y", "assets/a%20b.png?v=2 3#x y"},
+		{"assets/100%.png", "assets/100%25.png"},
+		{"assets/é.png", "assets/%C3%A9.png"},
+	}
+	for _, test := range tests {
+		if got := pathURL(test.ref); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.ref, got, test.want)
+		}
+	}
+}
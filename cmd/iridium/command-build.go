@@ -7,34 +7,52 @@ import (
 	"path"
 	"bufio"
 	"strings"
+	"strconv"
+	"html"
 	"io/ioutil"
+	"encoding/json"
 )
 
-func build(srcdir string) {
-	
+func buildCommand(args []string) {
+	flags := newFlags("build", "[--single-file] [--prune] [<folder>]")
+	singleFile := flags.Bool("single-file", false, "inline assets and stylesheets into game.html")
+	prune := flags.Bool("prune", false, "only copy the assets that passages and game.html reference")
+	srcdir := parseFolder(flags, args)
+	build(srcdir, *singleFile, *prune)
+}
+
+func build(srcdir string, singleFile bool, prune bool) {
+	// Asset references are collected, and inlined as data URIs for a
+	// single file.
+	inline := newInliner(srcdir, singleFile)
+
 	fmt.Println("Compiling passages")
-	content, err := compile(path.Join(srcdir, SRC_PASSAGES))
+	content, err := compile(path.Join(srcdir, SRC_PASSAGES), inline.asset)
 	if err != nil {
 		stop(fmt.Sprint(err))
 	}
-	
-	os.RemoveAll(path.Join(srcdir, GAME_DIST))
-	err = os.Mkdir(path.Join(srcdir, GAME_DIST), 0755)
+	template, err := ioutil.ReadFile(path.Join(srcdir, SRC_HTML))
 	if err != nil {
 		stop(fmt.Sprint(err))
 	}
-	fmt.Printf("Creating %s/%s\n", GAME_DIST, GAME_HTML)
-	file, err := os.Open(path.Join(srcdir, SRC_HTML))
+	page := inline.html(string(template))
+	// A failed build leaves the previous one in place.
+	if len(inline.errors) > 0 {
+		stop(strings.Join(inline.errors, "\n"))
+	}
+
+	os.RemoveAll(path.Join(srcdir, GAME_DIST))
+	err = os.Mkdir(path.Join(srcdir, GAME_DIST), 0755)
 	if err != nil {
 		stop(fmt.Sprint(err))
 	}
-	defer file.Close()
+	fmt.Printf("Creating %s/%s\n", GAME_DIST, GAME_HTML)
 	fileout, err := os.Create(path.Join(srcdir, GAME_DIST, GAME_HTML))
 	if err != nil {
 		stop(fmt.Sprint(err))
 	}
 	defer fileout.Close()
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(strings.NewReader(page))
 	for scanner.Scan() {
 		line := scanner.Text()
 		index := strings.Index(line, "</body>")
@@ -59,34 +77,74 @@ func build(srcdir string) {
 		stop(fmt.Sprint(err))
 	}
 	fileout.Sync()
+	if singleFile {
+		return
+	}
+	for file := range inline.used {
+		if !strings.HasPrefix(file, SRC_ASSETS + "/") {
+			fmt.Printf("warning: %s is used but not under %s, so it is not copied\n", file, SRC_ASSETS)
+		}
+	}
+	copyAssets(srcdir, inline.used, prune)
+}
 
-	stat, err := os.Stat(path.Join(srcdir, SRC_ASSETS))
-	if err == nil && stat.IsDir() {
-		// we got an assets folder - does it contain stuff?
-		files, err := ioutil.ReadDir(path.Join(srcdir, SRC_ASSETS))
-		if err == nil && len(files) > 0 {
-			// we got content! copy it
-			fmt.Printf("Creating %s/%s\n", GAME_DIST, GAME_ASSETS)
-			err = CopyDir(path.Join(srcdir, SRC_ASSETS), path.Join(srcdir, GAME_DIST, GAME_ASSETS))
-			if err != nil {
-				stop(fmt.Sprint(err))
-			}
+// copyAssets copies assets/ into dist/, or only the files in used when
+// pruning, and reports the assets that are not used.
+func copyAssets(srcdir string, used map[string]bool, prune bool) {
+	assetsDir := path.Join(srcdir, SRC_ASSETS)
+	files, err := listFiles(assetsDir)
+	if err != nil || len(files) == 0 {
+		return
+	}
+	unused := make([]string, 0)
+	for _, file := range files {
+		if !used[path.Join(SRC_ASSETS, file)] {
+			unused = append(unused, file)
+		}
+	}
+	fmt.Printf("Creating %s/%s\n", GAME_DIST, GAME_ASSETS)
+	if !prune {
+		if err := CopyDir(assetsDir, path.Join(srcdir, GAME_DIST, GAME_ASSETS)); err != nil {
+			stop(fmt.Sprint(err))
+		}
+		if len(unused) > 0 {
+			fmt.Printf("%d unused assets, build with --prune to leave them out\n", len(unused))
 		}
+		return
+	}
+	for _, file := range files {
+		if !used[path.Join(SRC_ASSETS, file)] {
+			continue
+		}
+		dst := path.Join(srcdir, GAME_DIST, GAME_ASSETS, file)
+		if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+			stop(fmt.Sprint(err))
+		}
+		if err := CopyFile(path.Join(assetsDir, file), dst); err != nil {
+			stop(fmt.Sprint(err))
+		}
+	}
+	for _, file := range unused {
+		fmt.Printf(" Pruning unused %s/%s\n", SRC_ASSETS, file)
 	}
 }
 
+// dumpGameJS writes game.json as the game object. It goes through the JSON
+// encoder, which escapes anything that could close the <script> element.
 func dumpGameJS(fileout io.Writer, gameJson string) {
-	file, err := os.Open(gameJson)
+	content, err := ioutil.ReadFile(gameJson)
 	if err != nil {
 		stop(fmt.Sprint(err))
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	fmt.Fprint(fileout, "const game = ")
-	for scanner.Scan() {
-		line := scanner.Text()
-		fmt.Fprintln(fileout, line)
+	var game interface{}
+	if err := json.Unmarshal(content, &game); err != nil {
+		stop(fmt.Sprintf("%s: %s", gameJson, err))
 	}
+	j, err := json.MarshalIndent(game, "", "    ")
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	fmt.Fprintf(fileout, "const game = %s\n", j)
 }
 
 // func dumpContentJS(fileout io.Writer, contentJS string) {
@@ -95,64 +153,199 @@ func dumpGameJS(fileout io.Writer, gameJson string) {
 // 		stop(fmt.Sprint(err))
 // 	}
 // 	defer file.Close()
-// 	scanner := bufio.NewScanner(file)
+// 	scanner := bufio.NewScanner(strings.NewReader(page))
 // 	for scanner.Scan() {
 // 		line := scanner.Text()
 // 		fmt.Fprintln(fileout, line)
 // 	}
 // }
 
-func joinText(items []Text) string {
-	texts := make([]string, len(items))
+// jsHTML builds a JavaScript expression evaluating to a piece of HTML,
+// from literal HTML and from expressions computed when the passage runs.
+type jsHTML struct {
+	parts []string
+	literal strings.Builder
+}
+
+func (h *jsHTML) html(s string) {
+	h.literal.WriteString(s)
+}
+
+func (h *jsHTML) expr(js string) {
+	if h.literal.Len() > 0 {
+		h.parts = append(h.parts, jsString(h.literal.String()))
+		h.literal.Reset()
+	}
+	h.parts = append(h.parts, js)
+}
+
+func (h *jsHTML) String() string {
+	if h.literal.Len() > 0 || len(h.parts) == 0 {
+		h.parts = append(h.parts, jsString(h.literal.String()))
+		h.literal.Reset()
+	}
+	return strings.Join(h.parts, " + ")
+}
+
+// jsText renders text as a JavaScript expression. Words are escaped, so
+// the only markup in the result is what the passage structure calls for.
+func jsText(items []Text) string {
+	h := &jsHTML{}
+	writeText(h, items)
+	return h.String()
+}
+
+func writeText(h *jsHTML, items []Text) {
 	for i, item := range(items) {
+		if i > 0 && !item.Glued {
+			h.html(" ")
+		}
 		switch (item.Kind) {
 		case TEXT_WORD:
-			texts[i] = item.Word
+			h.html(html.EscapeString(item.Word))
 		case TEXT_QUOTE:
-			texts[i] = "<q>" + joinText(item.Content) + "</q>"
+			h.html("<q>")
+			writeText(h, item.Content)
+			h.html("</q>")
+		case TEXT_EMPH:
+			h.html("<em>")
+			writeText(h, item.Content)
+			h.html("</em>")
+		case TEXT_STRONG:
+			h.html("<strong>")
+			writeText(h, item.Content)
+			h.html("</strong>")
+		case TEXT_SHOW:
+			h.expr("engine.escape(engine.show(" + jsExpr(item.Expr) + "))")
 		default:
 			stop(fmt.Sprintf("Unrecognized Text kind %d", item.Kind))
 		}
 	}
-	return strings.Join(texts, " ")
 }
 
-func compile(srcdir string) (string, error) {
+// jsString encodes s as a JavaScript string literal. It is safe to use
+// inside a <script> element, since it escapes <, > and &.
+func jsString(s string) string {
+	j, _ := json.Marshal(s)
+	return string(j)
+}
+
+func jsExpr(e *Expr) string {
+	switch e.Kind {
+	case EXPR_NUMBER:
+		f, _ := strconv.ParseFloat(e.Value, 64)
+		return showValue(f)
+	case EXPR_STRING:
+		return jsString(e.Value)
+	case EXPR_BOOL:
+		return e.Value
+	case EXPR_VAR:
+		return fmt.Sprintf("engine.get(state, %s)", jsString(e.Value))
+	}
+	args := make([]string, 0, len(e.Args) + 1)
+	args = append(args, jsString(e.Value))
+	for i := range e.Args {
+		args = append(args, jsExpr(&e.Args[i]))
+	}
+	return fmt.Sprintf("engine.op(%s)", strings.Join(args, ", "))
+}
+
+func jsBlocks(blocks []Block, assetURL func(string) string) string {
+	body := ""
+	for _, b := range(blocks) {
+		switch b.Kind {
+		case TEXT:
+			body += fmt.Sprintf("io.p(%s); ", jsText(b.Content))
+		case IMAGE:
+			body += fmt.Sprintf("io.img(%s, %s, %s); ", jsString(assetURL(b.Image)), jsString(b.Style), jsImageOptions(&b))
+		case SOUND:
+			body += fmt.Sprintf("io.sound(%s); ", jsString(assetURL(b.Sound)))
+		case MUSIC:
+			body += fmt.Sprintf("io.music(%s, %t); ", jsString(assetURL(b.Sound)), b.Loop)
+		case STOP_MUSIC:
+			body += "io.stopMusic(); "
+		case SET:
+			body += fmt.Sprintf("state[%s] = %s; ", jsString(b.Var), jsExpr(b.Expr))
+		case COND:
+			body += fmt.Sprintf("if (engine.truthy(%s)) { %s} ", jsExpr(b.Expr), jsBlocks(b.Then, assetURL))
+			if len(b.Else) > 0 {
+				body += fmt.Sprintf("else { %s} ", jsBlocks(b.Else, assetURL))
+			}
+		}
+	}
+	return body
+}
+
+// jsImageOptions is the object of the optional attributes of an image.
+func jsImageOptions(b *Block) string {
+	options := make([]string, 0, 4)
+	for _, attr := range [][2]string{{"alt", b.Alt}, {"caption", b.Caption}, {"width", b.Width}, {"class", b.Class}} {
+		if attr[1] != "" {
+			options = append(options, fmt.Sprintf("%s: %s", attr[0], jsString(attr[1])))
+		}
+	}
+	return "{" + strings.Join(options, ", ") + "}"
+}
+
+func jsOption(passageName string, options []Option, index int) string {
+	option := &options[index]
+	key := jsString(onceKey(passageName, options, index))
+	run := fmt.Sprintf("engine.goPassage(state, content, %s, true);", jsString(option.Target))
+	if option.Once {
+		run = fmt.Sprintf("state[%s] = true; %s", key, run)
+	}
+	conds := make([]string, 0, 2)
+	if option.Cond != nil {
+		conds = append(conds, fmt.Sprintf("engine.truthy(%s)", jsExpr(option.Cond)))
+	}
+	if option.Once {
+		conds = append(conds, fmt.Sprintf("!engine.truthy(engine.get(state, %s))", key))
+	}
+	text := jsText(option.Content)
+	if len(conds) == 0 {
+		return fmt.Sprintf("c = c.option(%s, function() { %s }); ", text, run)
+	}
+	cond := strings.Join(conds, " && ")
+	if option.Sticky {
+		// A sticky option without a run function shows as unavailable.
+		return fmt.Sprintf("c = c.option(%s, (%s) ? function() { %s } : null); ", text, cond, run)
+	}
+	return fmt.Sprintf("c = c.optionIf(%s, %s, function() { %s }); ", cond, text, run)
+}
+
+// compile turns the passages into JavaScript. Asset references go
+// through assetURL, with the file of the passage.
+func compile(srcdir string, assetURL func(string, string) string) (string, error) {
 	passages, err := getPassageNames(srcdir)
 	if err != nil {
 		return "", err
 	}
 	contentList := make([]string, 0)
+	// Report the parse errors of every passage, not just the first.
+	errors := make(ParseErrors, 0)
 	for _, passageName := range passages {
 		fmt.Println(" Processing", passageName)
-		passage, err := readPassage(srcdir, passageName)
-		if err != nil {
-			return "", err
-		}
-		r := strings.NewReader(passage)
-		p := NewParser(r)
-		psg, err := p.Parse()
-		if err != nil {
+		psg, err := parsePassage(srcdir, passageName)
+		if errs, ok := err.(ParseErrors); ok {
+			errors = append(errors, errs...)
+			continue
+		} else if err != nil {
 			return "", err
 		}
 		body := "let c = io.choices(); "
 		if len(psg.Title) > 0 {
-			body += fmt.Sprintf("io.t(\"%s\"); ", joinText(psg.Title))
+			body += fmt.Sprintf("io.t(%s); ", jsText(psg.Title))
 		}
-		for _, b := range(psg.Blocks) {
-			if b.Kind == TEXT {
-				body += fmt.Sprintf("io.p(\"%s\"); ", joinText(b.Content))
-			} else if b.Kind == IMAGE {
-				body += fmt.Sprintf("io.img(\"%s\", \"%s\"); ", b.Image, b.Style)
-			}
-		}
-		if len(psg.Options) > 0 {
-			for _, option := range(psg.Options) {
-				body += fmt.Sprintf("c = c.option(\"%s\", function() { engine.goPassage(state, content, \"%s\", true); }); ", joinText(option.Content), option.Target)
-			}
+		file := path.Join(srcdir, passageName + ".txt")
+		body += jsBlocks(psg.Blocks, func(ref string) string { return assetURL(ref, file) })
+		for i := range(psg.Options) {
+			body += jsOption(passageName, psg.Options, i)
 		}
 		body += "c.show();"
-		contentList = append(contentList, fmt.Sprintf("content[\"%s\"] = (function(state) { %s });", passageName, body))
+		contentList = append(contentList, fmt.Sprintf("content[%s] = (function(state) { %s });", jsString(passageName), body))
+	}
+	if len(errors) > 0 {
+		return "", errors
 	}
 	content := strings.Join(contentList, "\n")
 	return fmt.Sprintf("const content = function(fn) { let content = {};\n%s;\nreturn content;}\n", content), nil
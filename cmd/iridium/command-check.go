@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// Dead ends and unreachable passages are only warnings: endings are dead
+// ends, and a passage may be unfinished on purpose. Everything else is an
+// error, and makes the command exit nonzero.
+
+type checker struct {
+	errors int
+	warnings int
+}
+
+func (c *checker) errorf(where string, format string, args ...interface{}) {
+	c.errors += 1
+	fmt.Printf("%s: %s\n", where, fmt.Sprintf(format, args...))
+}
+
+func (c *checker) warnf(where string, format string, args ...interface{}) {
+	c.warnings += 1
+	fmt.Printf("%s: warning: %s\n", where, fmt.Sprintf(format, args...))
+}
+
+func at(file string, pos Pos) string {
+	return fmt.Sprintf("%s:%d:%d", file, pos.Line, pos.Col)
+}
+
+func check(srcdir string) {
+	story, err := loadStory(srcdir)
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	c := &checker{}
+	for _, e := range story.Errors {
+		c.errorf(at(e.File, e.Pos), "%s", e.Message)
+	}
+	for _, e := range story.Warnings {
+		c.errorf(at(e.File, e.Pos), "%s", e.Message)
+	}
+
+	exists := make(map[string]bool)
+	for _, name := range story.Names {
+		exists[name] = true
+	}
+	initial := story.Config.InitialPassage
+	if initial == "" {
+		c.errorf(path.Join(srcdir, SRC_JSON), "No init passage")
+	} else if !exists[initial] {
+		c.errorf(path.Join(srcdir, SRC_JSON), "Init passage %s does not exist", initial)
+	}
+
+	reachable := story.reachable()
+	for _, name := range story.Names {
+		psg, ok := story.Passages[name]
+		if !ok {
+			continue
+		}
+		file := story.passageFile(srcdir, name)
+		for _, option := range psg.Options {
+			if !exists[option.Target] {
+				c.errorf(at(file, option.Span.Start), "Option to missing passage %s", option.Target)
+			}
+		}
+		walkBlocks(psg.Blocks, func(b *Block) {
+			ref, what := b.Image, "image"
+			if b.Kind == SOUND || b.Kind == MUSIC {
+				ref, what = b.Sound, "sound"
+			} else if b.Kind != IMAGE {
+				return
+			}
+			asset := assetFile(srcdir, ref)
+			if asset == "" {
+				return
+			}
+			if _, err := os.Stat(asset); err != nil {
+				c.errorf(at(file, b.Span.Start), "Missing %s %s", what, ref)
+			}
+		})
+		if len(psg.Options) == 0 {
+			c.warnf(file, "Dead end: no options")
+		}
+		if initial != "" && !reachable[name] {
+			c.warnf(file, "Passage cannot be reached from %s", initial)
+		}
+	}
+
+	fmt.Printf("%d passages, %d errors, %d warnings\n", len(story.Names), c.errors, c.warnings)
+	if c.errors > 0 {
+		os.Exit(1)
+	}
+}
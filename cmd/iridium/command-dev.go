@@ -3,56 +3,375 @@ package main
 import (
 	"fmt"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"path"
 	"bufio"
 	"os"
 	"os/exec"
+	"os/signal"
 	"time"
 	"strings"
+	"strconv"
 	"io"
 	"io/ioutil"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"runtime"
+	"sync"
+	"syscall"
 	"encoding/json"
 )
 
-func devCommand(srcdir string) {
-	log.Printf("Starting server at port 8080\n")
+// How many ports above the requested one to try when it is taken.
+const portAttempts = 10
+
+func devCommand(args []string) {
+	flags := newFlags("dev", "[--host <host>] [--port <port>] [--token <token>] [--open|--no-open] [--browser <command>] [<folder>]")
+	host := flags.String("host", "localhost", "host or address to listen on; 0.0.0.0 listens on all interfaces")
+	port := flags.Int("port", 8080, "port to listen on; the next free port is used if it is taken")
+	open := flags.Bool("open", true, "open the game in a browser")
+	noOpen := flags.Bool("no-open", false, "do not open the game in a browser")
+	token := flags.String("token", "", "token that requests must carry, as ?token= or a Bearer authorization")
+	browser := flags.String("browser", "", "command to open the browser with, %s standing for the URL (default $BROWSER, or the system's)")
+	srcdir := parseFolder(flags, args)
 
 	assetsFileServer := http.FileServer(http.Dir(path.Join(srcdir, "/assets")))
 	http.HandleFunc("/", rootHandler(srcdir))
 	http.HandleFunc("/passage/", passageHandler(srcdir))
 	http.HandleFunc("/raw/", rawHandler(srcdir))
-	http.Handle("/assets/", http.StripPrefix("/assets/", assetsFileServer))
+	http.HandleFunc("/rename/", renameHandler(srcdir))
+	http.HandleFunc("/links/", linksHandler(srcdir))
+	http.HandleFunc("/passages", passagesHandler(srcdir))
+	http.Handle("/assets/", http.StripPrefix("/assets/", noCache(assetsFileServer)))
+
+	events := newDevEvents()
+	http.HandleFunc("/events", eventsHandler(events))
+	go watchFiles(srcdir, events)
+
+	listener, err := listenFrom(*host, *port)
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	url := serverURL(addr, *host)
+	var handler http.Handler = sameOrigin(serverHosts(addr, *host), http.DefaultServeMux)
+	if *token != "" {
+		handler = requireToken(*token, handler)
+		url += "?token=" + neturl.QueryEscape(*token)
+	} else if !addr.IP.IsLoopback() {
+		log.Printf("Warning: anyone who can reach %s can edit the game; consider --token\n", addr)
+	}
+	log.Printf("Serving %s at %s\n", srcdir, url)
 
-	go startBrowser(1)
+	// Cancelling the base context ends the event streams, which would
+	// otherwise hold up the shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &http.Server{Handler: handler, BaseContext: func(net.Listener) context.Context { return ctx }}
+	done := make(chan bool)
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		<-interrupt
+		log.Println("Shutting down")
+		cancel()
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancelShutdown()
+		server.Shutdown(shutdownCtx)
+		close(done)
+	}()
 
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if *open && !*noOpen {
+		go startBrowser(*browser, url)
+	}
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-done
+}
+
+// listenFrom listens on the first free port from port on.
+func listenFrom(host string, port int) (net.Listener, error) {
+	var err error
+	for i := 0; i < portAttempts; i++ {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port + i)))
+		if err == nil {
+			if i > 0 {
+				log.Printf("Port %d is taken, using %d\n", port, port + i)
+			}
+			return listener, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func serverURL(addr *net.TCPAddr, host string) string {
+	if host == "" || addr.IP.IsUnspecified() {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s/", net.JoinHostPort(host, strconv.Itoa(addr.Port)))
+}
+
+// startBrowser opens url with the given command, $BROWSER, or whatever
+// the system uses to open URLs. In a command, %s stands for the URL;
+// without it, the URL is added at the end.
+func startBrowser(command string, url string) {
+	if command == "" {
+		// $BROWSER may list several commands, separated by colons.
+		command = strings.Split(os.Getenv("BROWSER"), string(os.PathListSeparator))[0]
+	}
+	var cmd *exec.Cmd
+	if command != "" {
+		fields := strings.Fields(command)
+		args := make([]string, 0, len(fields))
+		hasURL := false
+		for _, field := range fields[1:] {
+			if strings.Contains(field, "%s") {
+				field = strings.ReplaceAll(field, "%s", url)
+				hasURL = true
+			}
+			args = append(args, field)
+		}
+		if !hasURL {
+			args = append(args, url)
+		}
+		cmd = exec.Command(fields[0], args...)
+	} else {
+		switch runtime.GOOS {
+		case "darwin":
+			cmd = exec.Command("open", url)
+		case "windows":
+			cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+		default:
+			cmd = exec.Command("xdg-open", url)
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Cannot open a browser (%s), go to %s\n", err, url)
+		return
+	}
+	go cmd.Wait()
+}
+
+// serverHosts lists the host:port names the server answers to: the
+// loopback names, the host it listens on and, when it listens on all
+// interfaces, the names and addresses of the machine.
+func serverHosts(addr *net.TCPAddr, host string) map[string]bool {
+	names := []string{"localhost", "127.0.0.1", "::1", host, addr.IP.String()}
+	if host == "" || addr.IP.IsUnspecified() {
+		if hostname, err := os.Hostname(); err == nil {
+			names = append(names, hostname)
+		}
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range addrs {
+				if ipnet, ok := a.(*net.IPNet); ok {
+					names = append(names, ipnet.IP.String())
+				}
+			}
+		}
+	}
+	hosts := make(map[string]bool)
+	port := strconv.Itoa(addr.Port)
+	for _, name := range names {
+		if name != "" {
+			hosts[strings.ToLower(net.JoinHostPort(name, port))] = true
+		}
+	}
+	return hosts
+}
+
+// sameOrigin turns away requests that change files unless they come from
+// a page of the server itself, so that other web pages cannot edit the
+// game. Checking Host also defeats DNS rebinding, where another site's
+// name is made to point to the server.
+func sameOrigin(hosts map[string]bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ok := hosts[strings.ToLower(r.Host)]
+		if origin := r.Header.Get("Origin"); ok && origin != "" {
+			u, err := neturl.Parse(origin)
+			ok = err == nil && hosts[strings.ToLower(u.Host)]
+		}
+		if !ok {
+			log.Printf("Refusing %s %s from %s\n", r.Method, r.URL.Path, r.Header.Get("Origin"))
+			http.Error(w, "403 forbidden.", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+const tokenCookie = "iridium-token"
+
+// requireToken only lets through requests that carry the token. The
+// browser gets it in the URL it opens, and keeps it in a cookie for the
+// requests of the page.
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := r.URL.Query().Get("token")
+		if given == "" {
+			given = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if given == "" {
+			if cookie, err := r.Cookie(tokenCookie); err == nil {
+				given = cookie.Value
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "401 unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("token") != "" {
+			http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestPassage is the passage a request is for, or "" after replying
+// with an error if the name is not a valid passage name.
+func requestPassage(w http.ResponseWriter, r *http.Request, prefix string) string {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if err := checkPassageName(name); err != nil {
+		http.Error(w, "400 " + err.Error() + ".", http.StatusBadRequest)
+		return ""
+	}
+	return name
+}
+
+// parseErrorReply is the JSON body of a 422 reply for a passage that
+// does not parse: the first error, with its position, and all of them.
+type parseErrorReply struct {
+	Error string `json:"error"`
+	Line int `json:"line"`
+	Col int `json:"col"`
+	Errors []parseErrorReply `json:"errors,omitempty"`
+}
+
+func replyParseErrors(w http.ResponseWriter, errs ParseErrors) {
+	reply := parseErrorReply{Error: errs[0].Message, Line: errs[0].Pos.Line, Col: errs[0].Pos.Col}
+	for _, e := range errs {
+		reply.Errors = append(reply.Errors, parseErrorReply{Error: e.Message, Line: e.Pos.Line, Col: e.Pos.Col})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(reply)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "405 method not allowed.", http.StatusMethodNotAllowed)
+}
+
+// replyReadError replies to a passage that cannot be read: 404 when it
+// does not exist.
+func replyReadError(w http.ResponseWriter, passageName string, err error) {
+	if os.IsNotExist(err) {
+		http.Error(w, "404 no passage " + passageName + ".", http.StatusNotFound)
+		return
+	}
+	log.Println(err)
+	http.Error(w, "500 internal error.", http.StatusInternalServerError)
+}
+
+// Edits say what text they started from with the ETag of that text in
+// If-Match. An edit to a text changed since gets a 409 with both versions,
+// rather than replacing the change. editLock makes checking and writing
+// one step.
+var editLock sync.Mutex
+
+func etag(text string) string {
+	h := sha256.Sum256([]byte(text))
+	return fmt.Sprintf("\"%x\"", h[:16])
+}
+
+// editConflict is the JSON body of a 409 reply to an edit: the text as it
+// is now, with its ETag, and the text of the edit.
+type editConflict struct {
+	Error string `json:"error"`
+	ETag string `json:"etag"`
+	Current string `json:"current"`
+	Yours string `json:"yours"`
+}
+
+// ifMatch reports whether the If-Match of a request, if any, holds for
+// current, which may not exist.
+func ifMatch(r *http.Request, current string, exists bool) bool {
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		return true
+	}
+	if exists {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag(current) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// TODO: Abstract this away somehow.
-func startBrowser(secs int) {
-	time.Sleep(time.Duration(secs) * time.Second)
-	cmd := exec.Command("/Applications/Firefox.app/Contents/MacOS/firefox", "-private-window", "localhost:8080")
-	_ = cmd.Run()
+// checkIfMatch reports whether an edit to current, which may not exist,
+// can go ahead, replying with a conflict if not. Edits without If-Match
+// always go ahead.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, current string, exists bool, yours string) bool {
+	if ifMatch(r, current, exists) {
+		return true
+	}
+	conflict := editConflict{Error: "changed since it was read", Yours: yours}
+	if exists {
+		conflict.ETag = etag(current)
+		conflict.Current = current
+		w.Header().Set("ETag", conflict.ETag)
+	} else {
+		conflict.Error = "deleted since it was read"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(conflict)
+	return false
 }
 
 func passageHandler(srcdir string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		passageName := strings.TrimPrefix(r.URL.Path, "/passage/")
+		if r.Method != "GET" && r.Method != "HEAD" {
+			methodNotAllowed(w, "GET", "HEAD")
+			return
+		}
+		passageName := requestPassage(w, r, "/passage/")
+		if passageName == "" {
+			return
+		}
 		log.Println("Processing", passageName)
 		passage, err := readPassage(path.Join(srcdir, SRC_PASSAGES), passageName)
-		// need to check if the passage exists - if so, return 404!
 		if err != nil {
-			http.Error(w, "500 internal error.", http.StatusInternalServerError)
+			replyReadError(w, passageName, err)
 			return
 		}
 		rdr := strings.NewReader(passage)
 		p := NewParser(rdr)
 		psg, err := p.Parse()
+		if errs, ok := err.(ParseErrors); ok {
+			log.Printf("%s: %s\n", passageName, errs[0])
+			replyParseErrors(w, errs)
+			return
+		}
 		j, err := json.Marshal(*psg)
 		if err != nil {
+			log.Println(err)
 			http.Error(w, "500 internal error.", http.StatusInternalServerError)
 			return
 		}
@@ -63,67 +382,295 @@ func passageHandler(srcdir string) func(http.ResponseWriter, *http.Request) {
 
 func rawHandler(srcdir string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		passageName := strings.TrimPrefix(r.URL.Path, "/raw/")
-		if r.Method == "GET" { 
-			log.Println("Getting", passageName)
-			passage, err := readPassage(path.Join(srcdir, SRC_PASSAGES), passageName)
-			// need to check if the passage exists - if so, return 404!
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "PUT" && r.Method != "POST" && r.Method != "DELETE" {
+			methodNotAllowed(w, "GET", "HEAD", "PUT", "POST", "DELETE")
+			return
+		}
+		passageName := requestPassage(w, r, "/raw/")
+		if passageName == "" {
+			return
+		}
+		psgdir := path.Join(srcdir, SRC_PASSAGES)
+		// A delete may also say what text it saw with If-Match, and is
+		// refused with a 412 if the passage changed since.
+		if r.Method == "DELETE" {
+			editLock.Lock()
+			defer editLock.Unlock()
+			current, err := readPassage(psgdir, passageName)
 			if err != nil {
-				http.Error(w, "500 internal error.", http.StatusInternalServerError)
+				replyReadError(w, passageName, err)
+				return
+			}
+			if !ifMatch(r, current, true) {
+				w.Header().Set("ETag", etag(current))
+				http.Error(w, "412 passage " + passageName + " changed since it was read.", http.StatusPreconditionFailed)
+				return
+			}
+			log.Println("Deleting", passageName)
+			if err := os.Remove(path.Join(psgdir, passageName + ".txt")); err != nil {
+				replyReadError(w, passageName, err)
 				return
 			}
 			w.Header().Set("Content-Type", "text/plain")
-			fmt.Fprint(w, passage)
-		} else if r.Method == "PUT" {
+			fmt.Fprint(w, "ok")
+			return
+		}
+		if r.Method == "PUT" || r.Method == "POST" {
 			body, err := ioutil.ReadAll(r.Body)
 			if err != nil {
-				http.Error(w, "500 internal error.", http.StatusInternalServerError)
+				http.Error(w, "400 cannot read request.", http.StatusBadRequest)
 				return
 			}
 			text := string(body)
+			editLock.Lock()
+			defer editLock.Unlock()
+			current, err := readPassage(psgdir, passageName)
+			if err != nil && !os.IsNotExist(err) {
+				replyReadError(w, passageName, err)
+				return
+			}
+			// POST creates a passage, and does not replace one.
+			if r.Method == "POST" && err == nil {
+				http.Error(w, "409 passage " + passageName + " exists.", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				if err := checkNewPassageName(passageName); err != nil {
+					http.Error(w, "400 " + err.Error() + ".", http.StatusBadRequest)
+					return
+				}
+			}
+			if !checkIfMatch(w, r, current, err == nil, text) {
+				return
+			}
 			log.Println("Writing", passageName)
-			err = writePassage(path.Join(srcdir, SRC_PASSAGES), passageName, text)
+			err = writePassage(psgdir, passageName, text)
 			if err != nil {
+				log.Println(err)
 				http.Error(w, "500 internal error.", http.StatusInternalServerError)
 				return
 			}
 			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("ETag", etag(text))
+			if r.Method == "POST" {
+				w.WriteHeader(http.StatusCreated)
+			}
 			fmt.Fprint(w, "ok")
-		} else {
-			http.Error(w, "Method is not supported.", http.StatusNotFound)
+			return
+		}
+		log.Println("Getting", passageName)
+		passage, err := readPassage(psgdir, passageName)
+		if err != nil {
+			replyReadError(w, passageName, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", etag(passage))
+		fmt.Fprint(w, passage)
+	}
+}
+
+// renameHandler renames a passage to the "to" of a JSON body, rewriting
+// the options to it, and replies with the passages rewritten.
+func renameHandler(srcdir string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		passageName := requestPassage(w, r, "/rename/")
+		if passageName == "" {
+			return
+		}
+		// Only JSON, which a web page cannot send to another site
+		// without the browser asking first.
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "415 expected application/json.", http.StatusUnsupportedMediaType)
+			return
+		}
+		var request struct {
+			To string `json:"to"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "400 expected {\"to\": <name>}.", http.StatusBadRequest)
+			return
+		}
+		if err := checkNewPassageName(request.To); err != nil {
+			http.Error(w, "400 " + err.Error() + ".", http.StatusBadRequest)
+			return
+		}
+		editLock.Lock()
+		defer editLock.Unlock()
+		log.Println("Renaming", passageName, "to", request.To)
+		rewritten, err := renamePassage(path.Join(srcdir, SRC_PASSAGES), passageName, request.To)
+		if os.IsExist(err) {
+			http.Error(w, "409 passage " + request.To + " exists.", http.StatusConflict)
+			return
+		} else if err != nil {
+			replyReadError(w, passageName, err)
+			return
+		}
+		config, err := readConfig(srcdir)
+		if err == nil && config.InitialPassage == passageName {
+			err = renameInitialPassage(srcdir, passageName, request.To)
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "500 internal error.", http.StatusInternalServerError)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"passage": request.To, "rewritten": rewritten})
+	}
+}
+
+// linksHandler replies with the passages that have options to a passage,
+// and whether it is the initial passage, to warn before deleting it.
+func linksHandler(srcdir string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			methodNotAllowed(w, "GET", "HEAD")
+			return
+		}
+		passageName := requestPassage(w, r, "/links/")
+		if passageName == "" {
+			return
+		}
+		links, err := linksTo(path.Join(srcdir, SRC_PASSAGES), passageName)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "500 internal error.", http.StatusInternalServerError)
+			return
+		}
+		// Options of a passage to itself go with it.
+		incoming := make([]string, 0, len(links))
+		for _, name := range links {
+			if name != passageName {
+				incoming = append(incoming, name)
+			}
+		}
+		config, _ := readConfig(srcdir)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"incoming": incoming, "initial": config.InitialPassage == passageName})
+	}
+}
+
+// passageSummary describes a passage in the /passages index. Passages
+// that do not parse have Error set, with what links could be read.
+type passageSummary struct {
+	Name string `json:"name"`
+	Title string `json:"title"`
+	Words int `json:"words"`
+	Outgoing []string `json:"outgoing"`
+	Incoming []string `json:"incoming"`
+	Error string `json:"error,omitempty"`
+	Line int `json:"line,omitempty"`
+	Col int `json:"col,omitempty"`
+}
+
+// passagesHandler replies with an index of the passages. With ?q=, only
+// passages whose text holds q, ignoring case, are listed.
+func passagesHandler(srcdir string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			methodNotAllowed(w, "GET", "HEAD")
+			return
+		}
+		psgdir := path.Join(srcdir, SRC_PASSAGES)
+		names, err := getPassageNames(psgdir)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "500 internal error.", http.StatusInternalServerError)
+			return
+		}
+		query := strings.ToLower(r.URL.Query().Get("q"))
+		summaries := make([]*passageSummary, 0, len(names))
+		byName := make(map[string]*passageSummary)
+		matches := make(map[string]bool)
+		for _, name := range names {
+			text, err := readPassage(psgdir, name)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, "500 internal error.", http.StatusInternalServerError)
+				return
+			}
+			matches[name] = strings.Contains(strings.ToLower(text), query)
+			summary := &passageSummary{Name: name, Outgoing: make([]string, 0), Incoming: make([]string, 0)}
+			psg, err := NewParser(strings.NewReader(text)).Parse()
+			if errs, ok := err.(ParseErrors); ok {
+				summary.Error, summary.Line, summary.Col = errs[0].Message, errs[0].Pos.Line, errs[0].Pos.Col
+			}
+			summary.Title = plainText(psg.Title)
+			summary.Words = passageWords(psg)
+			seen := make(map[string]bool)
+			for _, option := range psg.Options {
+				if !seen[option.Target] {
+					seen[option.Target] = true
+					summary.Outgoing = append(summary.Outgoing, option.Target)
+				}
+			}
+			summaries = append(summaries, summary)
+			byName[name] = summary
+		}
+		// Incoming links are found over every passage, searched or not.
+		for _, summary := range summaries {
+			for _, target := range summary.Outgoing {
+				if to, ok := byName[target]; ok {
+					to.Incoming = append(to.Incoming, summary.Name)
+				}
+			}
+		}
+		found := make([]*passageSummary, 0, len(summaries))
+		for _, summary := range summaries {
+			if matches[summary.Name] {
+				found = append(found, summary)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(found)
 	}
 }
 
 func notesHandler(srcdir string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" { 
-			log.Println("Getting notes")
+		// Missing notes are empty notes.
+		readNotes := func() string {
 			content, err := ioutil.ReadFile(path.Join(srcdir, SRC_NOTES))
-			notes := ""
-			if err == nil {
-				// Silently swallow errors and return "" for notes instead.
-				notes = string(content)
+			if err != nil {
+				return ""
 			}
+			return string(content)
+		}
+		if r.Method == "GET" || r.Method == "HEAD" {
+			log.Println("Getting notes")
+			notes := readNotes()
 			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("ETag", etag(notes))
 			fmt.Fprint(w, notes)
 		} else if r.Method == "PUT" {
 			body, err := ioutil.ReadAll(r.Body)
 			if err != nil {
-				http.Error(w, "500 internal error.", http.StatusInternalServerError)
+				http.Error(w, "400 cannot read request.", http.StatusBadRequest)
 				return
 			}
 			text := string(body)
+			editLock.Lock()
+			defer editLock.Unlock()
+			if !checkIfMatch(w, r, readNotes(), true, text) {
+				return
+			}
 			log.Println("Writing notes")
-			err = ioutil.WriteFile(path.Join(srcdir, SRC_NOTES), []byte(text), 0644)
+			err = writeFileAtomic(path.Join(srcdir, SRC_NOTES), []byte(text), 0644)
 			if err != nil {
+				log.Println(err)
 				http.Error(w, "500 internal error.", http.StatusInternalServerError)
 				return
 			}
 			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("ETag", etag(text))
 			fmt.Fprint(w, "ok")
 		} else {
-			http.Error(w, "Method is not supported.", http.StatusNotFound)
+			methodNotAllowed(w, "GET", "HEAD", "PUT")
 		}
 	}
 }
@@ -138,6 +685,10 @@ func rootHandler(srcdir string) func(http.ResponseWriter, *http.Request) {
 			http.Error(w, "404 not found.", http.StatusNotFound)
 			return
 		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			methodNotAllowed(w, "GET", "HEAD")
+			return
+		}
 		file, err := os.Open(path.Join(srcdir, SRC_HTML))
 		if err != nil {
 			log.Fatal(err)
@@ -168,22 +719,119 @@ func rootHandler(srcdir string) func(http.ResponseWriter, *http.Request) {
 }
 
 func dumpDevContent(w io.Writer, psgdir string) {
-	fmt.Fprintln(w, `
+	fmt.Fprint(w, `
 
 function content() { 
   const cntnt = {}; 
   cntnt[game.init] = function(state) { 
+     // Coming back from a reload: pick up where we were.
+     const saved = sessionStorage.getItem(savedHistoryKey);
+     if (saved) {
+       sessionStorage.removeItem(savedHistoryKey);
+       history.push(...JSON.parse(saved));
+       processLastPassage(false);
+       return;
+     }
      processPassage(game.init, state, false);
   };
   return cntnt;
 }
 
+const savedHistoryKey = 'iridium-dev-history';
+
+// set while a passage or the notes are being edited, to hold off reloads
+let editing = false;
+
+const changes = new EventSource('/events');
+changes.addEventListener('change', event => {
+  const change = JSON.parse(event.data);
+  if (editing) {
+    return;
+  }
+  if (change.reload) {
+    sessionStorage.setItem(savedHistoryKey, JSON.stringify(history));
+    location.reload();
+  } else {
+    // Clear the screen so the passage is replaced rather than repeated.
+    io.newp(true);
+    processLastPassage(false);
+  }
+  if (sidebar) {
+    searchPassages();
+  }
+});
+
 const buttonStyle = 'margin-left: 16px; padding: calc(.5em - 1px) 1em; background-color: #00947e; color: #fff; border-radius: 2px; border-width: 1px; border-color: transparent; font-size: .8rem; cursor: pointer;';
 
 const devMessageStyle = 'color: #00947e;'
 
+const errorStyle = 'color: red; font-family: monospace; font-size: 80%;';
+
 const history = [];
 
+// The sidebar lists the passages, filtered by name or searched in their
+// text, and jumps to one with a state given as JSON, which starts out as
+// the state of the passage shown.
+let sidebar = null;
+let passageList = [];
+
+const sidebarStyle = 'position: fixed; top: 0; right: 0; width: 320px; height: 100vh; overflow-y: auto; box-sizing: border-box; padding: 12px; background: #fff; border-left: 1px solid #ccc; font-size: 80%; z-index: 10;';
+
+const fieldStyle = 'display: block; width: 100%; box-sizing: border-box; margin-bottom: 8px; border: 1px solid #ccc; border-radius: 4px; padding: 4px;';
+
+function toggleSidebar() {
+   if (sidebar) {
+     sidebar.remove();
+     sidebar = null;
+     return;
+   }
+   sidebar = document.createElement('div');
+   sidebar.setAttribute('style', sidebarStyle);
+   sidebar.innerHTML = '<div style="display: flex; align-items: center; justify-content: space-between; margin-bottom: 8px;"><b style="' + devMessageStyle + '">Passages</b><button style="' + buttonStyle + '" onclick="toggleSidebar()">Close</button></div>'
+     + '<input id="dev-filter" placeholder="Filter by name" style="' + fieldStyle + '" oninput="showPassageList()">'
+     + '<input id="dev-search" placeholder="Search text" style="' + fieldStyle + '" onchange="searchPassages()">'
+     + '<label style="' + devMessageStyle + '">State</label><textarea id="dev-state" style="' + fieldStyle + ' height: 8em; font-family: monospace;"></textarea>'
+     + '<div id="dev-passages"></div>';
+   document.body.appendChild(sidebar);
+   const last = history[history.length - 1];
+   document.getElementById('dev-state').value = JSON.stringify(last ? last.state : (game.global || {}), null, 1);
+   searchPassages();
+}
+
+function searchPassages() {
+   const query = document.getElementById('dev-search').value;
+   fetch('/passages' + (query ? '?q=' + encodeURIComponent(query) : ''))
+     .then(response => response.json())
+     .then(list => {
+       passageList = list;
+       showPassageList();
+     })
+}
+
+function showPassageList() {
+   const filter = document.getElementById('dev-filter').value.toLowerCase();
+   const items = passageList.filter(p => p.name.toLowerCase().includes(filter)).map(p => {
+     let info = p.words + ' words, links out: ' + engine.escape(p.outgoing.join(', ') || 'none') + ', in: ' + engine.escape(p.incoming.join(', ') || 'none');
+     if (p.error) {
+       info += '<div style="color: red;">Line ' + p.line + ', column ' + p.col + ': ' + engine.escape(p.error) + '</div>';
+     }
+     return '<div style="margin: 8px 0; cursor: pointer;" onclick="jumpTo(' + jsArg(p.name) + ')"><b>' + engine.escape(p.name) + '</b> ' + engine.escape(p.title)
+       + '<div style="color: #777;">' + info + '</div></div>';
+   });
+   document.getElementById('dev-passages').innerHTML = items.join('') || 'No passages';
+}
+
+function jumpTo(psg) {
+   let state;
+   try {
+     state = JSON.parse(document.getElementById('dev-state').value);
+   } catch (e) {
+     alert('The state is not valid JSON: ' + e.message);
+     return;
+   }
+   processPassage(psg, state, true);
+}
+
 function processLastPassage(clear) {
   if (history.length > 0) {
     let last = history.pop()
@@ -192,44 +840,144 @@ function processLastPassage(clear) {
 }
 
 function processPassage(psg, state, clear) {
+   editing = false;
    if (clear) { 
      io.newp();
    }
    let previousButton = history.length > 0 ? '<button style="' + buttonStyle + '" onclick="previous()">Previous</button>' : ''
-   io.html('<div style="display: flex; flex-direction: row; align-items: center; margin-bottom: 16px;"><span style="' + devMessageStyle + '"><b>Passage: ' + psg + '</b></span> <button style="' + buttonStyle + '" onclick="edit(\'' + psg + '\', true)">Edit</button> <button style="' + buttonStyle + '" onclick="editNotes()">Notes</button> ' + previousButton + '</div>');
+   io.html('<div style="display: flex; flex-direction: row; align-items: center; margin-bottom: 16px;"><span style="' + devMessageStyle + '"><b>Passage: ' + engine.escape(psg) + '</b></span> <button style="' + buttonStyle + '" onclick="edit(' + jsArg(psg) + ', true)">Edit</button> <button style="' + buttonStyle + '" onclick="rename(' + jsArg(psg) + ')">Rename</button> <button style="' + buttonStyle + '" onclick="remove(' + jsArg(psg) + ')">Delete</button> <button style="' + buttonStyle + '" onclick="editNotes()">Notes</button> <button style="' + buttonStyle + '" onclick="toggleSidebar()">Passages</button> ' + previousButton + '</div>');
 
    history.push({passage: psg, state: structuredClone(state)})
 
-   fetch(encodeURI('/passage/' + psg))
+   fetch('/passage/' + encodeURIComponent(psg))
      .then(response => { 
         if (response.status === 200) { 
           response.json()
             .then(json => processJSON(json, psg, state));
-        } else { 
-          io.html('<span style="color: red;"><b>No such passage</b></span>');
+        } else if (response.status === 422) {
+          response.json()
+            .then(json => showParseErrors(json));
+        } else if (response.status === 404) {
+          io.html('<span style="' + errorStyle + '"><b>No such passage</b></span> <button style="' + buttonStyle + '" onclick="edit(' + jsArg(psg) + ', false)">Create this passage</button>');
+        } else {
+          response.text()
+            .then(text => io.html('<span style="' + errorStyle + '"><b>' + engine.escape(text) + '</b></span>'));
         }
     })
 }
 
+// jsArg quotes a string as an argument in an onclick attribute.
+function jsArg(s) {
+   return engine.escape(JSON.stringify(s));
+}
+
+function rename(psg) {
+   const to = prompt('Rename passage ' + psg + ' to:', psg);
+   if (!to || to === psg) {
+     return;
+   }
+   fetch('/rename/' + encodeURIComponent(psg), {
+       method: 'POST',
+       headers: {
+          'Content-Type': 'application/json'
+       },
+       body: JSON.stringify({to: to})
+   }).then(response => {
+       if (response.status !== 200) {
+         response.text().then(text => alert(text));
+         return;
+       }
+       for (const h of history) {
+         if (h.passage === psg) {
+           h.passage = to;
+         }
+       }
+       processLastPassage(true);
+   })
+}
+
+// The passage is deleted only if it is still the text read before asking.
+function remove(psg) {
+   Promise.all([fetch('/raw/' + encodeURIComponent(psg)), fetch('/links/' + encodeURIComponent(psg)).then(response => response.json())])
+     .then(([raw, links]) => {
+       let message = 'Delete passage ' + psg + '?';
+       if (links.initial) {
+         message += '\n\nIt is the initial passage of the game.';
+       }
+       if (links.incoming.length > 0) {
+         message += '\n\nOptions in these passages lead to it:\n  ' + links.incoming.join('\n  ');
+       }
+       if (!confirm(message)) {
+         return;
+       }
+       const headers = {};
+       if (raw.headers.get('ETag')) {
+         headers['If-Match'] = raw.headers.get('ETag');
+       }
+       fetch('/raw/' + encodeURIComponent(psg), { method: 'DELETE', headers: headers })
+         .then(response => {
+           if (response.status !== 200) {
+             response.text().then(text => alert(text));
+             return;
+           }
+           history.pop();
+           if (history.length > 0) {
+             processLastPassage(true);
+           } else {
+             io.newp();
+             io.html('<span style="' + devMessageStyle + '"><b>Deleted passage ' + engine.escape(psg) + '</b></span>');
+           }
+         })
+     })
+}
+
+// Parse errors show under the Edit button, each with its position.
+function showParseErrors(json) {
+   const errors = json.errors || [json];
+   io.html('<div style="' + errorStyle + '">' + errors.map(e => '<div><b>Line ' + e.line + ', column ' + e.col + ':</b> ' + engine.escape(e.error) + '</div>').join('') + '</div>');
+}
+
 // put image name here when rendering so that if we hit edit we can access it
 let imageName = null;
 
-function joinText(items) { 
-  return items.map(itemText).join(' ')
+function joinText(items, state) { 
+  return items.map((item, i) => (i > 0 && !item.Glued ? ' ' : '') + itemText(item, state)).join('')
 }
 
-function itemText(item) { 
+function itemText(item, state) { 
   ///console.log(item)
   switch(item.Kind) { 
     case 0: // WORD
-      return item.Word
+      return engine.escape(item.Word)
     case 1: // QUOTE
-      return '<q>' + joinText(item.Content) + '</q>'
+      return '<q>' + joinText(item.Content, state) + '</q>'
+    case 2: // EMPH
+      return '<em>' + joinText(item.Content, state) + '</em>'
+    case 3: // STRONG
+      return '<strong>' + joinText(item.Content, state) + '</strong>'
+    case 4: // SHOW
+      return engine.escape(engine.show(evalExpr(item.Expr, state)))
     default:
       return '??'
   }
 }
 
+function evalExpr(e, state) { 
+  switch(e.Kind) { 
+    case 0: // NUMBER
+      return Number(e.Value)
+    case 1: // STRING
+      return e.Value
+    case 2: // BOOL
+      return e.Value === 'true'
+    case 3: // VAR
+      return engine.get(state, e.Value)
+    case 4: // CALL
+      return engine.op(e.Value, ...e.Args.map(a => evalExpr(a, state)))
+  }
+  return null
+}
+
 function previous() {
   if (history.length > 1) {
     history.pop()
@@ -240,36 +988,79 @@ function previous() {
 function processJSON(json, psg, state) {
    imageName = null;
    if (json.Title.length > 0) {
-     io.t(joinText(json.Title));
+     io.t(joinText(json.Title, state));
+   }
+   processBlocks(json.Blocks, state);
+   let c = io.choices();
+   json.Options.forEach((opt, i) => {
+     // Must agree with onceKey in command-run.go.
+     const nth = json.Options.slice(0, i).filter(o => o.Once && o.Target === opt.Target).length;
+     const key = 'taken "' + psg + '" "' + opt.Target + '" ' + nth;
+     const enabled = (!opt.Cond || engine.truthy(evalExpr(opt.Cond, state))) && !(opt.Once && engine.truthy(engine.get(state, key)));
+     if (!enabled && !opt.Sticky) {
+       return;
+     }
+     c = c.option(joinText(opt.Content, state), enabled ? function() {
+       if (opt.Once) {
+         state[key] = true;
+       }
+       processPassage(opt.Target, state, true)
+     } : null);
+   });
+   c.show();
+}
+
+// assetURL makes the path of an asset in a passage a URL, as build does.
+function assetURL(ref) {
+   if (!ref || ref.startsWith('data:') || ref.startsWith('#') || ref.includes('://') || ref.startsWith('//')) {
+     return ref;
    }
-   for (let b of json.Blocks) {
+   const end = ref.search(/[?#]/) < 0 ? ref.length : ref.search(/[?#]/);
+   return ref.slice(0, end).split('/').map(encodeURIComponent).join('/') + ref.slice(end);
+}
+
+function processBlocks(blocks, state) {
+   for (let b of blocks || []) {
      switch(b.Kind) { 
        case 0:   // TEXT
-         io.p(joinText(b.Content));
+         io.p(joinText(b.Content, state));
          break;
        case 1:   // IMAGE
-         io.img(b.Image, b.Style);
+         io.img(assetURL(b.Image), b.Style, {alt: b.Alt, caption: b.Caption, width: b.Width, "class": b.Class});
          if (!imageName) { 
-           imageName = b.Image;
+           imageName = assetURL(b.Image);
          }
          break;
+       case 2:   // SET
+         state[b.Var] = evalExpr(b.Expr, state);
+         break;
+       case 3:   // COND
+         processBlocks(engine.truthy(evalExpr(b.Expr, state)) ? b.Then : b.Else, state);
+         break;
+       case 4:   // SOUND
+         io.sound(assetURL(b.Sound));
+         break;
+       case 5:   // MUSIC
+         io.music(assetURL(b.Sound), b.Loop);
+         break;
+       case 6:   // STOP_MUSIC
+         io.stopMusic();
+         break;
      }
    }
-   let c = io.choices();
-   for (let opt of json.Options) { 
-     c = c.option(joinText(opt.Content), function() { processPassage(opt.Target, state, true) });
-   }
-   c.show();
 }
 
 function edit(psg, exists) { 
+   editing = true;
+   editTag = null;
    io.newp();
-   io.html('<div style="display: flex; flex-direction: row; align-items: center; margin-bottom: 16px;"><span style="' + devMessageStyle + '"><b>Passage: ' + psg + '</b></span> <button style="' + buttonStyle + '" onclick="save(\'' + psg + '\')">Save</button> <button style="' + buttonStyle + '" onclick="processLastPassage(true)">Cancel</button></div>');
+   io.html('<div style="display: flex; flex-direction: row; align-items: center; margin-bottom: 16px;"><span style="' + devMessageStyle + '"><b>Passage: ' + engine.escape(psg) + '</b></span> <button style="' + buttonStyle + '" onclick="save(' + jsArg(psg) + ', ' + exists + ')">Save</button> <button style="' + buttonStyle + '" onclick="processLastPassage(true)">Cancel</button></div>');
 
    if (exists) { 
-     fetch(encodeURI('/raw/' + psg))
+     fetch('/raw/' + encodeURIComponent(psg))
        .then(response => { 
           if (response.status === 200) { 
+            editTag = response.headers.get('ETag');
             response.text()
               .then(text => createTextArea(text));
           } else { 
@@ -282,12 +1073,15 @@ function edit(psg, exists) {
 }
 
 function editNotes() {
+   editing = true;
+   editTag = null;
    io.newp();
    io.html('<div style="display: flex; flex-direction: row; align-items: center; margin-bottom: 16px;"><span style="' + devMessageStyle + '"><b>NOTES</b></span> <button style="' + buttonStyle + '" onclick="saveNotes()">Save</button> <button style="' + buttonStyle + '" onclick="processLastPassage(true)">Cancel</button></div>');
 
    fetch(encodeURI('/notes'))
      .then(response => { 
         if (response.status === 200) { 
+          editTag = response.headers.get('ETag');
           response.text()
             .then(text => createTextArea(text, true));
         } else { 
@@ -298,32 +1092,117 @@ function editNotes() {
 
 function saveNotes() {
    const text = document.querySelector('textarea').value;
-   fetch(encodeURI('/notes'), {
-       method: 'PUT',
-       headers: { 
-          'Content-Type': 'text/plain'
-       },
-       body: text
-   }).then(response => processLastPassage(true))
+   putText('/notes', 'PUT', text, 'NOTES');
 }
 
+const textAreaStyle = 'resize: vertical; width: 100%; height: 80vh; font-size: 70%; border: 1px solid #ccc; border-radius: 8px; padding: 8px;';
+
 function createTextArea(init, noImage) {
    if (imageName && !noImage) { 
-      io.html('<div style="display: flex; flex-direction: row; align-items: flex-start; width: 100%;"><textarea style="flex: 1 0; resize: vertical; width: 60%; height: 80vh; font-size: 70%; border: 1px solid #ccc; border-radius: 8px; padding: 8px;">' + init + '</textarea> <img src="' + imageName + '" style="width: 30%; margin-left: 16px;"></div>');
+      io.html('<div style="display: flex; flex-direction: row; align-items: flex-start; width: 100%;"><textarea style="flex: 1 0; resize: vertical; width: 60%; height: 80vh; font-size: 70%; border: 1px solid #ccc; border-radius: 8px; padding: 8px;">' + engine.escape(init) + '</textarea> <img src="' + engine.escape(imageName) + '" style="width: 30%; margin-left: 16px;"></div>');
    } else { 
-      io.html('<textarea style="resize: vertical; width: 100%; height: 80vh; font-size: 70%; border: 1px solid #ccc; border-radius: 8px; padding: 8px;">' + init + '</textarea>');
+      io.html('<textarea style="' + textAreaStyle + '">' + engine.escape(init) + '</textarea>');
    }
 }
 
-function save(psg) { 
+// New passages are created with POST, which does not replace a passage
+// created in the meantime.
+function save(psg, exists) { 
    const text = document.querySelector('textarea').value;
-   fetch(encodeURI('/raw/' + psg), {
-       method: 'PUT',
-       headers: { 
-          'Content-Type': 'text/plain'
-       },
+   putText('/raw/' + encodeURIComponent(psg), exists ? 'PUT' : 'POST', text, 'Passage: ' + psg);
+}
+
+// The ETag of the text being edited, sent back with it in If-Match so
+// that a text changed in the meantime is not overwritten.
+let editTag = null;
+
+// What was being saved when the text turned out to have changed.
+let conflict = null;
+
+function putText(url, method, text, title) {
+   const headers = {
+      'Content-Type': 'text/plain'
+   };
+   if (editTag) {
+      headers['If-Match'] = editTag;
+   }
+   fetch(url, {
+       method: method,
+       headers: headers,
        body: text
-   }).then(response => processLastPassage(true))
+   }).then(response => {
+       if (response.status === 409 && response.headers.get('Content-Type') === 'application/json') {
+         response.json().then(reply => showConflict(url, title, reply));
+         return;
+       }
+       if (response.status !== 200 && response.status !== 201) {
+         response.text().then(text => alert(text));
+         return;
+       }
+       processLastPassage(true);
+   })
+}
+
+// showConflict shows how the text on disk differs from the edit, with
+// the edit to merge into and save over it, or to replace by the text on
+// disk.
+function showConflict(url, title, reply) {
+   editing = true;
+   conflict = {url: url, title: title, reply: reply};
+   io.newp();
+   io.html('<div style="display: flex; flex-direction: row; align-items: center; margin-bottom: 16px;"><span style="' + devMessageStyle + '"><b>' + engine.escape(title) + '</b></span> <button style="' + buttonStyle + '" onclick="saveMerged()">Save mine</button> <button style="' + buttonStyle + '" onclick="takeTheirs()">Take theirs</button> <button style="' + buttonStyle + '" onclick="processLastPassage(true)">Cancel</button></div>');
+   io.html('<div style="' + errorStyle + '"><b>The text was ' + engine.escape(reply.error) + '.</b> Lines marked - are on disk, lines marked + are yours. Merge into your text below, then save it.</div>');
+   const lines = lineDiff(reply.current.split('\n'), reply.yours.split('\n')).map(d => {
+      const color = d[0] === '-' ? '#fdd' : d[0] === '+' ? '#dfd' : 'transparent';
+      return '<div style="background: ' + color + ';">' + engine.escape(d[0] + ' ' + d[1]) + '</div>';
+   });
+   io.html('<pre style="font-size: 70%; border: 1px solid #ccc; border-radius: 8px; padding: 8px; white-space: pre-wrap;">' + lines.join('') + '</pre>');
+   io.html('<textarea style="' + textAreaStyle + ' height: 40vh;">' + engine.escape(reply.yours) + '</textarea>');
+}
+
+function saveMerged() {
+   const text = document.querySelector('textarea').value;
+   // The merge is an edit of the text on disk, or recreates it.
+   editTag = conflict.reply.etag || null;
+   putText(conflict.url, 'PUT', text, conflict.title);
+}
+
+function takeTheirs() {
+   document.querySelector('textarea').value = conflict.reply.current;
+}
+
+// lineDiff lines up two texts by their longest common subsequence of
+// lines, marking lines only in a with - and lines only in b with +.
+function lineDiff(a, b) {
+   const common = [];
+   for (let i = a.length; i >= 0; i--) {
+     common[i] = [];
+     for (let j = b.length; j >= 0; j--) {
+       if (i === a.length || j === b.length) {
+         common[i][j] = 0;
+       } else if (a[i] === b[j]) {
+         common[i][j] = common[i + 1][j + 1] + 1;
+       } else {
+         common[i][j] = Math.max(common[i + 1][j], common[i][j + 1]);
+       }
+     }
+   }
+   const diff = [];
+   let i = 0, j = 0;
+   while (i < a.length || j < b.length) {
+     if (i < a.length && j < b.length && a[i] === b[j]) {
+       diff.push([' ', a[i]]);
+       i++;
+       j++;
+     } else if (j === b.length || (i < a.length && common[i + 1][j] >= common[i][j + 1])) {
+       diff.push(['-', a[i]]);
+       i++;
+     } else {
+       diff.push(['+', b[j]]);
+       j++;
+     }
+   }
+   return diff;
 }
 `)
 }
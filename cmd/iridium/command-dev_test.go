@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// devStory makes a story folder with the given passages.
+func devStory(t *testing.T, passages map[string]string) string {
+	srcdir := t.TempDir()
+	psgdir := path.Join(srcdir, SRC_PASSAGES)
+	if err := os.Mkdir(psgdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range passages {
+		if err := ioutil.WriteFile(path.Join(psgdir, name + ".txt"), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return srcdir
+}
+
+func TestPassagesWords(t *testing.T) {
+	srcdir := devStory(t, map[string]string{
+		"start": "One two three.\n\nShe said \"hello there friend\" loudly.\n\n(# option \"end\") Go on (# end)",
+		"end": "(+em The) end.",
+	})
+	w := httptest.NewRecorder()
+	passagesHandler(srcdir)(w, httptest.NewRequest("GET", "/passages", nil))
+	var summaries []passageSummary
+	if err := json.NewDecoder(w.Body).Decode(&summaries); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"start": 11, "end": 2}
+	if len(summaries) != len(want) {
+		t.Fatalf("got %d passages, want %d", len(summaries), len(want))
+	}
+	for _, summary := range summaries {
+		if summary.Words != want[summary.Name] {
+			t.Errorf("%s: got %d words, want %d", summary.Name, summary.Words, want[summary.Name])
+		}
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	srcdir := devStory(t, map[string]string{"start": "Start.", "gone": "Gone."})
+	tests := []struct {
+		ifMatch string
+		status int
+	}{
+		{etag("Gone, before an edit."), 412},
+		{etag("Gone."), 200},
+		{etag("Gone."), 404},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("DELETE", "/raw/gone", nil)
+		r.Header.Set("If-Match", test.ifMatch)
+		w := httptest.NewRecorder()
+		rawHandler(srcdir)(w, r)
+		if w.Code != test.status {
+			t.Errorf("If-Match %s: got %d, want %d", test.ifMatch, w.Code, test.status)
+		}
+	}
+	if _, err := os.Stat(path.Join(srcdir, SRC_PASSAGES, "start.txt")); err != nil {
+		t.Error(err)
+	}
+}
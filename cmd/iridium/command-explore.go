@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// explore plays the game many times with random choices, through the same
+// player as iridium run, and reports what went wrong along the way:
+//
+//  - options to missing passages, and passages that fail to parse
+//  - stuck passages, with options but none that can be taken
+//  - infinite loops, where the game comes back to the same passage with
+//    the same state without the player having had a choice
+//  - walks that do not reach an ending within the step limit
+//
+// Walks are reproducible from the seed.
+
+// Only the end of long walks is shown.
+const maxPathShown = 20
+
+type explorer struct {
+	story *Story
+	rng *rand.Rand
+	maxSteps int
+	// Problems are reported once, with the first walk that ran into them.
+	problems []string
+	seen map[string]int
+	passages map[string]int
+	options map[string]int
+	endings int
+}
+
+// exploreStep is a passage a walk went through, with the option taken.
+type exploreStep struct {
+	passage string
+	choice int
+	choices int
+}
+
+func (e *explorer) problem(walk int, steps []exploreStep, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	e.seen[message] += 1
+	if e.seen[message] > 1 {
+		return
+	}
+	e.problems = append(e.problems, message)
+	fmt.Printf("walk %d: %s\n", walk, message)
+	path := make([]string, len(steps))
+	for i, step := range steps {
+		path[i] = step.passage
+		if step.choice > 0 {
+			path[i] += fmt.Sprintf(" (%d)", step.choice)
+		}
+	}
+	if len(path) > maxPathShown {
+		path = append([]string{"..."}, path[len(path) - maxPathShown:]...)
+	}
+	fmt.Printf("  %s\n", strings.Join(path, " > "))
+}
+
+func stateKey(passage string, state State) string {
+	// encoding/json sorts map keys.
+	j, _ := json.Marshal(state)
+	return passage + " " + string(j)
+}
+
+func (e *explorer) walk(walk int, p *player) {
+	steps := make([]exploreStep, 0)
+	// Where each passage and state was first met in the walk.
+	met := make(map[string]int)
+	for len(steps) < e.maxSteps {
+		key := stateKey(p.passage, p.state)
+		if first, ok := met[key]; ok {
+			forced := true
+			for _, step := range steps[first:] {
+				forced = forced && step.choices == 1
+			}
+			if forced {
+				e.problem(walk, append(steps, exploreStep{p.passage, 0, 0}), "Infinite loop through %s", p.passage)
+				return
+			}
+		} else {
+			met[key] = len(steps)
+		}
+		e.passages[p.passage] += 1
+		psg, choices, state, err := p.show()
+		if err != nil {
+			if _, ok := err.(ParseErrors); ok {
+				e.problem(walk, steps, "Parse error in %s:\n%s", p.passage, err)
+			} else {
+				e.problem(walk, steps, "Cannot read passage %s: %s", p.passage, err)
+			}
+			return
+		}
+		step := exploreStep{p.passage, 0, len(choices)}
+		if len(choices) == 0 {
+			steps = append(steps, step)
+			if len(psg.Options) > 0 {
+				e.problem(walk, steps, "Stuck in %s: none of its %d options can be taken", p.passage, len(psg.Options))
+			} else {
+				e.endings += 1
+			}
+			return
+		}
+		step.choice = e.rng.Intn(len(choices)) + 1
+		steps = append(steps, step)
+		index := choices[step.choice - 1]
+		e.options[optionKey(p.passage, index)] += 1
+		target := psg.Options[index].Target
+		if !e.story.has(target) {
+			e.problem(walk, steps, "Option %d of %s goes to missing passage %s", index + 1, p.passage, target)
+			return
+		}
+		p.take(psg, index, state)
+	}
+	e.problem(walk, steps, "No ending after %d steps", e.maxSteps)
+}
+
+func optionKey(passage string, index int) string {
+	return fmt.Sprintf("%s %d", passage, index)
+}
+
+func explore(args []string) {
+	flags := newFlags("explore", "[--walks <n>] [--seed <s>] [--steps <n>] [<folder>]")
+	walks := flags.Int("walks", 100, "number of random walks")
+	seed := flags.Int64("seed", 0, "seed of the random choices (default from the clock)")
+	maxSteps := flags.Int("steps", 1000, "longest walk before giving up on reaching an ending")
+	srcdir := parseFolder(flags, args)
+	seeded := false
+	flags.Visit(func(f *flag.Flag) {
+		seeded = seeded || f.Name == "seed"
+	})
+	if !seeded {
+		*seed = time.Now().UnixNano()
+	}
+
+	story, err := loadStory(srcdir)
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	e := &explorer{
+		story: story,
+		rng: rand.New(rand.NewSource(*seed)),
+		maxSteps: *maxSteps,
+		seen: make(map[string]int),
+		passages: make(map[string]int),
+		options: make(map[string]int),
+	}
+	fmt.Printf("Exploring %d walks with --seed %d\n", *walks, *seed)
+	// Walks print nothing of the game itself.
+	output = ioutil.Discard
+	for walk := 1; walk <= *walks; walk++ {
+		e.walk(walk, newPlayer(srcdir, story.Config))
+	}
+	output = os.Stdout
+	e.report()
+	if len(e.problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func (e *explorer) report() {
+	fmt.Println()
+	fmt.Println("Passages reached:")
+	names := append([]string{}, e.story.Names...)
+	sort.Strings(names)
+	reached := 0
+	options := 0
+	taken := 0
+	for _, name := range names {
+		count := e.passages[name]
+		if count > 0 {
+			reached += 1
+		}
+		fmt.Printf(" %6d  %s\n", count, name)
+		psg, ok := e.story.Passages[name]
+		if !ok {
+			continue
+		}
+		for i, option := range psg.Options {
+			options += 1
+			count := e.options[optionKey(name, i)]
+			if count > 0 {
+				taken += 1
+			}
+			fmt.Printf(" %6d    %d. %s -> %s\n", count, i + 1, plainText(option.Content), option.Target)
+		}
+	}
+	fmt.Println()
+	fmt.Printf("%d/%d passages reached, %d/%d options taken, %d endings reached, %d problems\n", reached, len(names), taken, options, e.endings, len(e.problems))
+}
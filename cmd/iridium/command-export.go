@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Stories are exported to Twee 3 for the Harlowe story format, Twine's
+// default. Annotations become Harlowe macros: options become links,
+// wrapped in (if:) when they have conditions, and once options become
+// (link:) macros that record that they were taken.
+
+const harloweVersion = "3.3.8"
+
+func exportCommand(args []string) {
+	if len(args) == 0 || args[0] != "twee" {
+		stop("USAGE: iridium export twee [--out <file>] [<folder>]")
+	}
+	flags := newFlags("export twee", "[--out <file>] [<folder>]")
+	out := flags.String("out", "", "file to write (default standard output)")
+	srcdir := parseFolder(flags, args[1:])
+
+	story, err := loadStory(srcdir)
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	if len(story.Errors) > 0 {
+		stop(fmt.Sprint(story.Errors))
+	}
+	if clashes := harloweClashes(story); len(clashes) > 0 {
+		stop("Variables with the same name in Harlowe:\n" + strings.Join(clashes, "\n"))
+	}
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			stop(fmt.Sprint(err))
+		}
+		defer w.Close()
+	}
+	b := bufio.NewWriter(w)
+	writeTwee(b, story)
+	if err := b.Flush(); err != nil {
+		stop(fmt.Sprint(err))
+	}
+}
+
+// storyIFID is the IFID of the game, or one made up from its title and
+// author, so that exporting again gives the same story to Twine.
+func storyIFID(config GameConfig) string {
+	if config.IFID != "" {
+		return config.IFID
+	}
+	h := sha1.Sum([]byte(config.Title + "\n" + config.Author))
+	// A name-based UUID, version 5.
+	h[6] = (h[6] & 0x0f) | 0x50
+	h[8] = (h[8] & 0x3f) | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16]))
+}
+
+var tweeSpecial = regexp.MustCompile(`[\\\[\]{}]`)
+
+func tweeName(name string) string {
+	return tweeSpecial.ReplaceAllString(name, `\$0`)
+}
+
+func writeTwee(w io.Writer, story *Story) {
+	fmt.Fprintf(w, ":: StoryTitle\n%s\n\n", story.Config.Title)
+	data := map[string]interface{}{
+		"ifid": storyIFID(story.Config),
+		"format": "Harlowe",
+		"format-version": harloweVersion,
+		"start": story.Config.InitialPassage,
+		"zoom": 1,
+	}
+	j, _ := json.MarshalIndent(data, "", "  ")
+	fmt.Fprintf(w, ":: StoryData\n%s\n\n", j)
+	if story.Config.Subtitle != "" {
+		fmt.Fprintf(w, ":: StorySubtitle\n%s\n\n", story.Config.Subtitle)
+	}
+	if story.Config.Author != "" {
+		fmt.Fprintf(w, ":: StoryAuthor\n%s\n\n", story.Config.Author)
+	}
+	if len(story.Config.Global) > 0 {
+		fmt.Fprintf(w, ":: %s [startup]\n", tweeName(startupName(story)))
+		for _, name := range sortedKeys(story.Config.Global) {
+			fmt.Fprintf(w, "(set: %s to %s)\n", harloweVar(name), harloweValue(story.Config.Global[name]))
+		}
+		fmt.Fprintln(w)
+	}
+	for _, name := range story.Names {
+		fmt.Fprintf(w, ":: %s\n%s\n\n", tweeName(name), harlowePassage(name, story.Passages[name]))
+	}
+}
+
+// startupName is a name for the passage that sets the global variables,
+// which no passage of the story has.
+func startupName(story *Story) string {
+	name := "Startup"
+	for i := 2; story.has(name); i++ {
+		name = fmt.Sprintf("Startup %d", i)
+	}
+	return name
+}
+
+func harlowePassage(name string, psg *Passage) string {
+	parts := make([]string, 0)
+	if len(psg.Title) > 0 {
+		parts = append(parts, "## " + harloweText(psg.Title))
+	}
+	if blocks := harloweBlocks(psg.Blocks); blocks != "" {
+		parts = append(parts, blocks)
+	}
+	options := make([]string, 0, len(psg.Options))
+	for i := range psg.Options {
+		options = append(options, harloweOption(name, psg.Options, i))
+	}
+	if len(options) > 0 {
+		parts = append(parts, strings.Join(options, "\n"))
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func harloweBlocks(blocks []Block) string {
+	parts := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		switch b.Kind {
+		case TEXT:
+			parts = append(parts, harloweText(b.Content))
+		case IMAGE:
+			parts = append(parts, htmlImage(&b))
+		case SOUND, MUSIC:
+			// Harlowe has no audio of its own, so music only plays
+			// while its passage is shown.
+			loop := ""
+			if b.Loop {
+				loop = " loop"
+			}
+			parts = append(parts, fmt.Sprintf("<audio src=\"%s\" autoplay%s></audio>", htmlAttr(b.Sound), loop))
+		case SET:
+			parts = append(parts, fmt.Sprintf("(set: %s to %s)", harloweVar(b.Var), harloweExpr(b.Expr)))
+		case COND:
+			s := fmt.Sprintf("(if: %s)[%s]", harloweExpr(b.Expr), harloweBlocks(b.Then))
+			if len(b.Else) > 0 {
+				s += fmt.Sprintf("(else:)[%s]", harloweBlocks(b.Else))
+			}
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// htmlImage is the markup core-js.go makes for an image.
+func htmlImage(b *Block) string {
+	style := b.Style
+	if b.Width != "" {
+		style = strings.TrimSpace("width: " + b.Width + "; " + style)
+	}
+	img := fmt.Sprintf("<img src=\"%s\" alt=\"%s\"", htmlAttr(b.Image), htmlAttr(b.Alt))
+	if style != "" {
+		img += fmt.Sprintf(" style=\"%s\"", htmlAttr(style))
+	}
+	img += ">"
+	class := ""
+	if b.Class != "" {
+		class = fmt.Sprintf(" class=\"%s\"", htmlAttr(b.Class))
+	}
+	if b.Caption == "" {
+		if class != "" {
+			return strings.Replace(img, "<img", "<img" + class, 1)
+		}
+		return img
+	}
+	return fmt.Sprintf("<figure%s>%s<figcaption>%s</figcaption></figure>", class, img, html.EscapeString(b.Caption))
+}
+
+func htmlAttr(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "&", "&amp;"), "\"", "&quot;")
+}
+
+// linkSafe reports whether s can go in a [[link]]: links end at brackets,
+// and arrows and bars separate their text from their target.
+func linkSafe(s string) bool {
+	return !strings.ContainsAny(s, "[]`|") && !strings.Contains(s, "->") && !strings.Contains(s, "<-")
+}
+
+func harloweOption(passage string, options []Option, index int) string {
+	option := options[index]
+	text := harloweText(option.Content)
+	// Links take their text as written, so markup, and what linkSafe
+	// rules out, go in a (link-goto:).
+	link := fmt.Sprintf("[[%s->%s]]", text, option.Target)
+	if !linkSafe(text) || !linkSafe(option.Target) {
+		link = fmt.Sprintf("(link-goto: %s, %s)", harloweString(plainText(option.Content)), harloweString(option.Target))
+	}
+	conds := make([]string, 0, 2)
+	if option.Cond != nil {
+		conds = append(conds, harloweExpr(option.Cond))
+	}
+	if option.Once {
+		taken := harloweVar(onceKey(passage, options, index))
+		conds = append(conds, fmt.Sprintf("%s is not true", taken))
+		link = fmt.Sprintf("(link: %s)[(set: %s to true)(go-to: %s)]", harloweString(plainText(option.Content)), taken, harloweString(option.Target))
+	}
+	if len(conds) == 0 {
+		return link
+	}
+	s := fmt.Sprintf("(if: %s)[%s]", strings.Join(conds, " and "), link)
+	if option.Sticky {
+		s += fmt.Sprintf("(else:)[%s]", text)
+	}
+	return s
+}
+
+// Words that Harlowe would read as markup are kept verbatim.
+var harloweMarkup = regexp.MustCompile("[$`<>\\[\\]*~^\\\\]|^_|''|//|\\([\\w-]+:")
+
+func harloweText(items []Text) string {
+	result := ""
+	for i, item := range items {
+		if i > 0 && !item.Glued {
+			result += " "
+		}
+		switch item.Kind {
+		case TEXT_WORD:
+			if strings.Contains(item.Word, "`") {
+				result += "`` " + item.Word + " ``"
+			} else if harloweMarkup.MatchString(item.Word) {
+				result += "`" + item.Word + "`"
+			} else {
+				result += item.Word
+			}
+		case TEXT_QUOTE:
+			result += "\"" + harloweText(item.Content) + "\""
+		case TEXT_EMPH:
+			result += "//" + harloweText(item.Content) + "//"
+		case TEXT_STRONG:
+			result += "''" + harloweText(item.Content) + "''"
+		case TEXT_SHOW:
+			result += "(print: " + harloweExpr(item.Expr) + ")"
+		}
+	}
+	return result
+}
+
+var harloweUnsafe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// harloweVar names an Iridium variable in Harlowe, which only allows
+// letters, digits and underscores.
+func harloweVar(name string) string {
+	return "$" + harloweUnsafe.ReplaceAllString(name, "_")
+}
+
+// harloweClashes lists the variables of the story that harloweVar gives
+// the same name, as in has-key and has_key.
+func harloweClashes(story *Story) []string {
+	names := make(map[string]bool)
+	var exprVars func(e *Expr)
+	exprVars = func(e *Expr) {
+		if e == nil {
+			return
+		}
+		if e.Kind == EXPR_VAR {
+			names[e.Value] = true
+		}
+		for i := range e.Args {
+			exprVars(&e.Args[i])
+		}
+	}
+	var textVars func(items []Text)
+	textVars = func(items []Text) {
+		for _, item := range items {
+			exprVars(item.Expr)
+			textVars(item.Content)
+		}
+	}
+	for name := range story.Config.Global {
+		names[name] = true
+	}
+	for _, name := range story.Names {
+		psg, ok := story.Passages[name]
+		if !ok {
+			continue
+		}
+		textVars(psg.Title)
+		walkBlocks(psg.Blocks, func(b *Block) {
+			if b.Kind == SET {
+				names[b.Var] = true
+			}
+			exprVars(b.Expr)
+			textVars(b.Content)
+		})
+		for i, option := range psg.Options {
+			exprVars(option.Cond)
+			textVars(option.Content)
+			if option.Once {
+				names[onceKey(name, psg.Options, i)] = true
+			}
+		}
+	}
+	byHarlowe := make(map[string][]string)
+	for name := range names {
+		byHarlowe[harloweVar(name)] = append(byHarlowe[harloweVar(name)], name)
+	}
+	clashes := make([]string, 0)
+	for v, vars := range byHarlowe {
+		if len(vars) > 1 {
+			sort.Strings(vars)
+			clashes = append(clashes, fmt.Sprintf("%s: %s", v, strings.Join(vars, ", ")))
+		}
+	}
+	sort.Strings(clashes)
+	return clashes
+}
+
+func harloweString(s string) string {
+	return "\"" + strings.ReplaceAll(strings.ReplaceAll(s, "\\", "\\\\"), "\"", "\\\"") + "\""
+}
+
+func harloweValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return harloweString(x)
+	case nil:
+		return "0"
+	case []interface{}:
+		values := make([]string, len(x))
+		for i := range x {
+			values[i] = harloweValue(x[i])
+		}
+		return strings.TrimSpace("(a: " + strings.Join(values, ", ")) + ")"
+	case map[string]interface{}:
+		values := make([]string, 0, 2 * len(x))
+		for _, k := range sortedKeys(x) {
+			values = append(values, harloweString(k), harloweValue(x[k]))
+		}
+		return strings.TrimSpace("(dm: " + strings.Join(values, ", ")) + ")"
+	default:
+		return showValue(x)
+	}
+}
+
+var harloweOperators = map[string]string{
+	"=": "is",
+	"!=": "is not",
+}
+
+func harloweExpr(e *Expr) string {
+	switch e.Kind {
+	case EXPR_STRING:
+		return harloweString(e.Value)
+	case EXPR_VAR:
+		return harloweVar(e.Value)
+	case EXPR_CALL:
+		args := make([]string, len(e.Args))
+		for i := range e.Args {
+			args[i] = harloweExpr(&e.Args[i])
+			if e.Args[i].Kind == EXPR_CALL {
+				args[i] = "(" + args[i] + ")"
+			}
+		}
+		if e.Value == "not" {
+			return "not " + args[0]
+		}
+		if len(args) == 1 {
+			if e.Value == "-" {
+				return "0 - " + args[0]
+			}
+			return args[0]
+		}
+		op, ok := harloweOperators[e.Value]
+		if !ok {
+			op = e.Value
+		}
+		return strings.Join(args, " " + op + " ")
+	}
+	return e.Value
+}
+
+func sortedKeys(state State) []string {
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
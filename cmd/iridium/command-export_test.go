@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHarloweValue(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want string
+	}{
+		{5.0, "5"},
+		{"say \"hi\"", "\"say \\\"hi\\\"\""},
+		{true, "true"},
+		{nil, "0"},
+		{[]interface{}{}, "(a:)"},
+		{[]interface{}{"key", 2.0, []interface{}{}}, "(a: \"key\", 2, (a:))"},
+		{map[string]interface{}{"b": true, "a": map[string]interface{}{}}, "(dm: \"a\", (dm:), \"b\", true)"},
+	}
+	for _, test := range tests {
+		if got := harloweValue(test.value); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestStartupName(t *testing.T) {
+	tests := []struct {
+		names []string
+		want string
+	}{
+		{[]string{"start"}, "Startup"},
+		{[]string{"start", "Startup"}, "Startup 2"},
+		{[]string{"Startup", "Startup 2"}, "Startup 3"},
+	}
+	for _, test := range tests {
+		if got := startupName(&Story{Names: test.names}); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.names, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type graphNode struct {
+	Name string `json:"name"`
+	Title string `json:"title,omitempty"`
+	Init bool `json:"init,omitempty"`
+	DeadEnd bool `json:"deadEnd,omitempty"`
+	// Missing nodes are the targets of broken links.
+	Missing bool `json:"missing,omitempty"`
+	ParseError bool `json:"parseError,omitempty"`
+	Options []graphEdge `json:"options"`
+}
+
+type graphEdge struct {
+	Target string `json:"target"`
+	Label string `json:"label"`
+	Conditional bool `json:"conditional,omitempty"`
+	Broken bool `json:"broken,omitempty"`
+}
+
+func storyGraph(story *Story) []*graphNode {
+	nodes := make([]*graphNode, 0, len(story.Names))
+	exists := make(map[string]bool)
+	for _, name := range story.Names {
+		exists[name] = true
+	}
+	missing := make(map[string]bool)
+	missingNodes := make([]*graphNode, 0)
+	for _, name := range story.Names {
+		node := &graphNode{Name: name, Init: name == story.Config.InitialPassage, Options: make([]graphEdge, 0)}
+		nodes = append(nodes, node)
+		psg, ok := story.Passages[name]
+		if !ok {
+			node.ParseError = true
+			continue
+		}
+		node.Title = plainText(psg.Title)
+		node.DeadEnd = len(psg.Options) == 0
+		for _, option := range psg.Options {
+			edge := graphEdge{
+				Target: option.Target,
+				Label: plainText(option.Content),
+				Conditional: option.Cond != nil || option.Once,
+				Broken: !exists[option.Target],
+			}
+			node.Options = append(node.Options, edge)
+			if edge.Broken && !missing[option.Target] {
+				missing[option.Target] = true
+				missingNodes = append(missingNodes, &graphNode{Name: option.Target, Missing: true, Options: make([]graphEdge, 0)})
+			}
+		}
+	}
+	return append(nodes, missingNodes...)
+}
+
+func graph(args []string) {
+	flags := newFlags("graph", "[--format dot|mermaid|json] [<folder>]")
+	format := flags.String("format", "dot", "output format: dot, mermaid or json")
+	srcdir := parseFolder(flags, args)
+
+	story, err := loadStory(srcdir)
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	for _, e := range story.Errors {
+		fmt.Fprintln(os.Stderr, e)
+	}
+	nodes := storyGraph(story)
+	switch *format {
+	case "dot":
+		writeDot(os.Stdout, story.Config.Title, nodes)
+	case "mermaid":
+		writeMermaid(os.Stdout, nodes)
+	case "json":
+		j, err := json.MarshalIndent(map[string]interface{}{"init": story.Config.InitialPassage, "passages": nodes}, "", "  ")
+		if err != nil {
+			stop(fmt.Sprint(err))
+		}
+		fmt.Println(string(j))
+	default:
+		stop(fmt.Sprintf("Unknown graph format: %s", *format))
+	}
+}
+
+func dotString(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	return "\"" + strings.ReplaceAll(s, "\n", "\\n") + "\""
+}
+
+func nodeLabel(node *graphNode) string {
+	if node.Title == "" {
+		return node.Name
+	}
+	return node.Name + "\n" + node.Title
+}
+
+func writeDot(w io.Writer, title string, nodes []*graphNode) {
+	fmt.Fprintf(w, "digraph %s {\n", dotString(title))
+	fmt.Fprintln(w, "  node [shape=box];")
+	for _, node := range nodes {
+		attrs := []string{"label=" + dotString(nodeLabel(node))}
+		if node.Init {
+			attrs = append(attrs, "style=\"filled,bold\"", "fillcolor=lightblue")
+		} else if node.DeadEnd {
+			attrs = append(attrs, "style=filled", "fillcolor=lightgray")
+		}
+		if node.DeadEnd {
+			attrs = append(attrs, "peripheries=2")
+		}
+		if node.Missing {
+			attrs = append(attrs, "style=dashed", "color=red", "fontcolor=red")
+		}
+		if node.ParseError {
+			attrs = append(attrs, "color=red", "penwidth=2")
+		}
+		fmt.Fprintf(w, "  %s [%s];\n", dotString(node.Name), strings.Join(attrs, ", "))
+	}
+	for _, node := range nodes {
+		for _, edge := range node.Options {
+			attrs := []string{"label=" + dotString(edge.Label)}
+			if edge.Conditional {
+				attrs = append(attrs, "style=dashed")
+			}
+			if edge.Broken {
+				attrs = append(attrs, "color=red", "fontcolor=red")
+			}
+			fmt.Fprintf(w, "  %s -> %s [%s];\n", dotString(node.Name), dotString(edge.Target), strings.Join(attrs, ", "))
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// mermaidString quotes a label; Mermaid has entity codes but no escapes.
+func mermaidString(s string) string {
+	s = strings.ReplaceAll(s, "\"", "#quot;")
+	s = strings.ReplaceAll(s, "<", "#lt;")
+	s = strings.ReplaceAll(s, ">", "#gt;")
+	return "\"" + strings.ReplaceAll(s, "\n", "<br/>") + "\""
+}
+
+func writeMermaid(w io.Writer, nodes []*graphNode) {
+	// Passage names are not valid Mermaid ids, so number the nodes.
+	ids := make(map[string]string)
+	for i, node := range nodes {
+		ids[node.Name] = fmt.Sprintf("p%d", i)
+	}
+	fmt.Fprintln(w, "flowchart TD")
+	classes := map[string][]string{}
+	for _, node := range nodes {
+		id := ids[node.Name]
+		if node.DeadEnd {
+			fmt.Fprintf(w, "  %s([%s])\n", id, mermaidString(nodeLabel(node)))
+		} else {
+			fmt.Fprintf(w, "  %s[%s]\n", id, mermaidString(nodeLabel(node)))
+		}
+		if node.Init {
+			classes["init"] = append(classes["init"], id)
+		}
+		if node.DeadEnd {
+			classes["deadend"] = append(classes["deadend"], id)
+		}
+		if node.Missing {
+			classes["missing"] = append(classes["missing"], id)
+		}
+		if node.ParseError {
+			classes["parseerror"] = append(classes["parseerror"], id)
+		}
+	}
+	brokenLinks := make([]string, 0)
+	link := 0
+	for _, node := range nodes {
+		for _, edge := range node.Options {
+			arrow := "-->"
+			if edge.Conditional {
+				arrow = "-.->"
+			}
+			fmt.Fprintf(w, "  %s %s|%s| %s\n", ids[node.Name], arrow, mermaidString(edge.Label), ids[edge.Target])
+			if edge.Broken {
+				brokenLinks = append(brokenLinks, fmt.Sprint(link))
+			}
+			link += 1
+		}
+	}
+	fmt.Fprintln(w, "  classDef init fill:#add8e6,stroke-width:3px")
+	fmt.Fprintln(w, "  classDef deadend fill:#d3d3d3")
+	fmt.Fprintln(w, "  classDef missing stroke:#f00,color:#f00,stroke-dasharray:5 5")
+	fmt.Fprintln(w, "  classDef parseerror stroke:#f00,stroke-width:3px")
+	for _, class := range []string{"init", "deadend", "missing", "parseerror"} {
+		if len(classes[class]) > 0 {
+			fmt.Fprintf(w, "  class %s %s\n", strings.Join(classes[class], ","), class)
+		}
+	}
+	if len(brokenLinks) > 0 {
+		fmt.Fprintf(w, "  linkStyle %s stroke:#f00,color:#f00\n", strings.Join(brokenLinks, ","))
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Stories are imported from Twine, either as Twee 3 source or as a
+// published Twine 2 HTML file. Links become options; story formats are
+// not understood, so their macros, variables and markup are kept in the
+// passages as comments and reported.
+
+type twineStory struct {
+	Title string
+	Subtitle string
+	Author string
+	IFID string
+	Start string
+	Format string
+	Passages []twinePassage
+}
+
+type twinePassage struct {
+	Name string
+	Tags []string
+	Text string
+}
+
+type importedConfig struct {
+	Title string `json:"title"`
+	Subtitle string `json:"subtitle"`
+	Author string `json:"author"`
+	InitialPassage string `json:"init"`
+	IFID string `json:"ifid,omitempty"`
+	Config map[string]interface{} `json:"config"`
+}
+
+type importer struct {
+	notes int
+	// Passages linked to but not found, by their Twine name.
+	missing map[string]bool
+}
+
+func (imp *importer) notef(where string, format string, args ...interface{}) {
+	imp.notes += 1
+	fmt.Printf("%s: %s\n", where, fmt.Sprintf(format, args...))
+}
+
+func importCommand(args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		stop("USAGE: iridium import twee|twine-html <file> [<folder>]")
+	}
+	content, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	imp := &importer{missing: make(map[string]bool)}
+	var story *twineStory
+	switch args[0] {
+	case "twee":
+		story = imp.readTwee(args[1], string(content))
+	case "twine-html":
+		story = imp.readTwineHTML(args[1], string(content))
+	default:
+		stop(fmt.Sprintf("Unknown import format: %s", args[0]))
+	}
+	dir := strings.TrimSuffix(path.Base(args[1]), path.Ext(args[1]))
+	if len(args) == 3 {
+		dir = args[2]
+	}
+	imp.write(story, dir)
+}
+
+var tweeHeader = regexp.MustCompile(`^::\s*((?:\\.|[^\\\[{])*)(?:\[((?:\\.|[^\]])*)\])?\s*(\{.*\})?\s*$`)
+var tweeEscape = regexp.MustCompile(`\\(.)`)
+
+func (imp *importer) readTwee(file string, content string) *twineStory {
+	story := &twineStory{Start: "Start"}
+	var current *twinePassage
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "::") {
+			if current != nil {
+				current.Text += line + "\n"
+			} else if strings.TrimSpace(line) != "" {
+				imp.notef(fmt.Sprintf("%s:%d", file, i + 1), "Text before the first passage is skipped")
+			}
+			continue
+		}
+		m := tweeHeader.FindStringSubmatch(line)
+		if m == nil {
+			imp.notef(fmt.Sprintf("%s:%d", file, i + 1), "Cannot read passage header %s", line)
+			current = nil
+			continue
+		}
+		story.Passages = append(story.Passages, twinePassage{
+			Name: tweeEscape.ReplaceAllString(strings.TrimSpace(m[1]), "$1"),
+			Tags: strings.Fields(tweeEscape.ReplaceAllString(m[2], "$1")),
+		})
+		current = &story.Passages[len(story.Passages) - 1]
+	}
+
+	// Special passages hold the story data.
+	passages := make([]twinePassage, 0, len(story.Passages))
+	for _, psg := range story.Passages {
+		text := strings.TrimSpace(psg.Text)
+		switch psg.Name {
+		case "StoryTitle":
+			story.Title = text
+		case "StorySubtitle":
+			story.Subtitle = text
+		case "StoryAuthor":
+			story.Author = text
+		case "StoryData":
+			var data struct {
+				IFID string
+				Start string
+				Format string
+			}
+			if err := json.Unmarshal([]byte(text), &data); err != nil {
+				imp.notef(file, "Cannot read StoryData: %s", err)
+			}
+			if data.Start != "" {
+				story.Start = data.Start
+			}
+			story.Format = data.Format
+			story.IFID = data.IFID
+		default:
+			passages = append(passages, psg)
+		}
+	}
+	story.Passages = passages
+	return story
+}
+
+var twineStoryData = regexp.MustCompile(`(?s)<tw-storydata([^>]*)>(.*?)</tw-storydata>`)
+var twinePassageData = regexp.MustCompile(`(?s)<tw-passagedata([^>]*)>(.*?)</tw-passagedata>`)
+var twineUserCode = regexp.MustCompile(`(?s)<(style|script)[^>]*id="twine-user-(?:stylesheet|script)"[^>]*>(.*?)</(?:style|script)>`)
+var htmlAttribute = regexp.MustCompile(`([\w-]+)="([^"]*)"`)
+
+func htmlAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range htmlAttribute.FindAllStringSubmatch(s, -1) {
+		attrs[m[1]] = html.UnescapeString(m[2])
+	}
+	return attrs
+}
+
+func (imp *importer) readTwineHTML(file string, content string) *twineStory {
+	m := twineStoryData.FindStringSubmatch(content)
+	if m == nil {
+		stop(fmt.Sprintf("%s: no Twine 2 story data", file))
+	}
+	attrs := htmlAttributes(m[1])
+	story := &twineStory{Title: attrs["name"], Format: attrs["format"], IFID: attrs["ifid"]}
+	for _, code := range twineUserCode.FindAllStringSubmatch(m[2], -1) {
+		if strings.TrimSpace(code[2]) != "" {
+			imp.notef(file, "Story %s is not converted", map[string]string{"style": "stylesheet", "script": "JavaScript"}[code[1]])
+		}
+	}
+	for _, p := range twinePassageData.FindAllStringSubmatch(m[2], -1) {
+		attrs := htmlAttributes(p[1])
+		if attrs["pid"] == htmlAttributes(m[1])["startnode"] {
+			story.Start = attrs["name"]
+		}
+		story.Passages = append(story.Passages, twinePassage{
+			Name: attrs["name"],
+			Tags: strings.Fields(attrs["tags"]),
+			Text: html.UnescapeString(p[2]),
+		})
+	}
+	return story
+}
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// passageNames maps Twine passage names, which can hold any character, to
+// names that make good file names.
+func passageNames(passages []twinePassage) map[string]string {
+	names := make(map[string]string)
+	for _, psg := range passages {
+		names[psg.Name] = fileName(psg.Name, names)
+	}
+	return names
+}
+
+// fileName makes a Twine passage name a good file name, different from
+// the names already given.
+func fileName(twineName string, names map[string]string) string {
+	used := make(map[string]bool)
+	for _, name := range names {
+		used[strings.ToLower(name)] = true
+	}
+	name := strings.Trim(unsafeName.ReplaceAllString(twineName, "-"), "-")
+	if name == "" {
+		name = "passage"
+	}
+	unique := name
+	for i := 2; used[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	return unique
+}
+
+// Link text cannot hold brackets, so links in Harlowe hooks, as in
+// (if: $x)[[[link]]], are found.
+var twineLink = regexp.MustCompile(`\[\[([^\[\]]*)\](\[[^\[\]]*\])?\]`)
+
+// Story format code that cannot be converted: SugarCube macros, Snowman
+// templates, Harlowe macros (matched up to their name, see
+// unconvertible), HTML tags and variables.
+var twineCode = regexp.MustCompile(`<<.*?>>|<%.*?%>|\([A-Za-z][\w-]*:|</?[A-Za-z][^>]*>|\$[A-Za-z_]\w*(?:\.\w+)*|\b_[A-Za-z]\w*`)
+
+// parseLink returns the text and the target of a link.
+func parseLink(link string) (string, string) {
+	if i := strings.LastIndex(link, "|"); i >= 0 {
+		return link[:i], link[i + 1:]
+	}
+	if i := strings.LastIndex(link, "->"); i >= 0 {
+		return link[:i], link[i + 2:]
+	}
+	if i := strings.Index(link, "<-"); i >= 0 {
+		return link[i + 2:], link[:i]
+	}
+	return link, link
+}
+
+// unconvertible finds the story format code in a line, as index pairs.
+func unconvertible(line string) [][]int {
+	found := twineCode.FindAllStringIndex(line, -1)
+	for _, loc := range found {
+		if line[loc[0]] != '(' {
+			continue
+		}
+		// Extend Harlowe macros to their closing parenthesis.
+		depth := 0
+		for i := loc[0]; i < len(line); i++ {
+			if line[i] == '(' {
+				depth += 1
+			} else if line[i] == ')' {
+				depth -= 1
+			}
+			loc[1] = i + 1
+			if depth == 0 {
+				break
+			}
+		}
+	}
+	// Drop matches inside the macros found before them.
+	result := make([][]int, 0, len(found))
+	for _, loc := range found {
+		if len(result) > 0 && loc[0] < result[len(result) - 1][1] {
+			continue
+		}
+		result = append(result, loc)
+	}
+	return result
+}
+
+// comment keeps code in a passage as an Iridium comment. Comments only
+// start and end at whitespace, so it gets some around it.
+func comment(code string) string {
+	return " (; " + strings.ReplaceAll(code, ";)", "; )") + " ;) "
+}
+
+// commentAsText reports whether comment syntax ended up read as text.
+func commentAsText(items []Text) bool {
+	for _, item := range items {
+		if strings.Contains(item.Word, "(;") || strings.Contains(item.Word, ";)") || commentAsText(item.Content) {
+			return true
+		}
+	}
+	return false
+}
+
+// iridiumText makes Twine text safe for the passage parser, which would
+// take (# and (+ for annotations and inline forms.
+func iridiumText(s string) string {
+	s = strings.ReplaceAll(s, "(#", "( #")
+	s = strings.ReplaceAll(s, "(+", "( +")
+	return strings.ReplaceAll(s, "(;", "( ;")
+}
+
+func (imp *importer) convertPassage(psg twinePassage, names map[string]string) string {
+	paragraphs := make([]string, 0)
+	options := make([]string, 0)
+	for i, line := range strings.Split(strings.TrimSpace(psg.Text), "\n") {
+		where := fmt.Sprintf("%s:%d", psg.Name, i + 1)
+		text := ""
+		last := 0
+		for _, loc := range twineLink.FindAllStringSubmatchIndex(line, -1) {
+			label, target := parseLink(line[loc[2]:loc[3]])
+			label, target = strings.TrimSpace(label), strings.TrimSpace(target)
+			if loc[4] >= 0 {
+				imp.notef(where, "Setter %s of link to %s is not converted", line[loc[4]:loc[5]], target)
+			}
+			// Missing passages get a name as if they were there, the
+			// same for every link to them.
+			if _, ok := names[target]; !ok {
+				names[target] = fileName(target, names)
+				imp.missing[target] = true
+			}
+			name := names[target]
+			if imp.missing[target] {
+				imp.notef(where, "Link to missing passage %s", target)
+			}
+			options = append(options, fmt.Sprintf("(# option \"%s\") %s (# end)", name, imp.convertText(where, label)))
+			// Links in the middle of text leave their label in place.
+			text += line[last:loc[0]] + label
+			last = loc[1]
+		}
+		text += line[last:]
+		if strings.TrimSpace(twineLink.ReplaceAllString(line, "")) == "" {
+			continue
+		}
+		paragraphs = append(paragraphs, imp.convertText(where, strings.TrimSpace(text)))
+	}
+	if len(options) > 0 {
+		paragraphs = append(paragraphs, strings.Join(options, "\n"))
+	}
+	return strings.Join(paragraphs, "\n\n") + "\n"
+}
+
+// convertText turns story format code into comments, and reports it.
+func (imp *importer) convertText(where string, line string) string {
+	result := ""
+	last := 0
+	for _, loc := range unconvertible(line) {
+		code := line[loc[0]:loc[1]]
+		imp.notef(where, "Cannot convert %s", code)
+		result = strings.TrimRight(result + strings.TrimLeft(iridiumText(line[last:loc[0]]), " "), " ") + comment(code)
+		last = loc[1]
+	}
+	return strings.TrimSpace(result + strings.TrimLeft(iridiumText(line[last:]), " "))
+}
+
+func (imp *importer) write(story *twineStory, dir string) {
+	if story.Format != "" {
+		fmt.Printf("Story format %s: its macros are not converted\n", story.Format)
+	}
+	passages := make([]twinePassage, 0, len(story.Passages))
+	for _, psg := range story.Passages {
+		skip := ""
+		for _, tag := range psg.Tags {
+			if tag == "script" || tag == "stylesheet" || tag == "widget" {
+				skip = tag
+			}
+		}
+		if skip != "" {
+			imp.notef(psg.Name, "Skipping %s passage", skip)
+			continue
+		}
+		passages = append(passages, psg)
+	}
+	names := passageNames(passages)
+	start, ok := names[story.Start]
+	if !ok {
+		imp.notef(dir, "Start passage %s not found", story.Start)
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		stop(fmt.Sprint(err))
+	}
+	if err := os.Mkdir(path.Join(dir, SRC_PASSAGES), 0755); err != nil {
+		stop(fmt.Sprint(err))
+	}
+	if err := os.Mkdir(path.Join(dir, SRC_ASSETS), 0755); err != nil {
+		stop(fmt.Sprint(err))
+	}
+	config := importedConfig{
+		Title: story.Title,
+		Subtitle: story.Subtitle,
+		Author: story.Author,
+		InitialPassage: start,
+		IFID: story.IFID,
+		Config: map[string]interface{}{"clear": true, "debug": false},
+	}
+	var j bytes.Buffer
+	encoder := json.NewEncoder(&j)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(config); err != nil {
+		stop(fmt.Sprint(err))
+	}
+	if err := ioutil.WriteFile(path.Join(dir, SRC_JSON), j.Bytes(), 0644); err != nil {
+		stop(fmt.Sprint(err))
+	}
+	if err := ioutil.WriteFile(path.Join(dir, SRC_HTML), []byte(gameHTML), 0644); err != nil {
+		stop(fmt.Sprint(err))
+	}
+	for _, psg := range passages {
+		name := names[psg.Name]
+		if name != psg.Name {
+			fmt.Printf("%s: renamed to %s\n", psg.Name, name)
+		}
+		text := imp.convertPassage(psg, names)
+		converted, err := NewParser(strings.NewReader(text)).Parse()
+		if err != nil {
+			imp.notef(psg.Name, "Converted passage does not parse:\n%s", err)
+		} else {
+			leaked := commentAsText(converted.Title)
+			walkBlocks(converted.Blocks, func(b *Block) {
+				leaked = leaked || commentAsText(b.Content)
+			})
+			for _, option := range converted.Options {
+				leaked = leaked || commentAsText(option.Content)
+			}
+			if leaked {
+				imp.notef(psg.Name, "Converted passage shows code meant as a comment")
+			}
+		}
+		if err := writePassage(path.Join(dir, SRC_PASSAGES), name, text); err != nil {
+			stop(fmt.Sprint(err))
+		}
+	}
+	fmt.Printf("Imported %d passages into %s, %d things to check\n", len(passages), dir, imp.notes)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConvertText(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"Plain text.", "Plain text."},
+		{"You have $gold.", "You have (; $gold ;) ."},
+		{"$a.b and $x.0, then _tmp.", "(; $a.b ;) and (; $x.0 ;) , then (; _tmp ;) ."},
+		{"<<if $x>>yes<</if>>", "(; <<if $x>> ;) yes (; <</if>> ;)"},
+		{"(if: $x)[shown] after", "(; (if: $x) ;) [shown] after"},
+		{"A <b>bold</b> word.", "A (; <b> ;) bold (; </b> ;) word."},
+		{"Not (#code) or (+this).", "Not ( #code) or ( +this)."},
+		{"Code with ;) in <<x \";)\">>", "Code with ;) in (; <<x \"; )\">> ;)"},
+	}
+	for _, test := range tests {
+		imp := &importer{missing: make(map[string]bool)}
+		if got := imp.convertText("test", test.line); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestConvertPassageLinks(t *testing.T) {
+	passages := []twinePassage{
+		{Name: "Start", Text: "[[Go->Missing \"<place>\"]]\n[[Again|Missing \"<place>\"]]\n[[Other->Missing-place]]\n[[Home->the end]]"},
+		{Name: "the end", Text: "Done."},
+	}
+	imp := &importer{missing: make(map[string]bool)}
+	names := passageNames(passages)
+	got := imp.convertPassage(passages[0], names)
+	want := "(# option \"Missing-place\") Go (# end)\n" +
+		"(# option \"Missing-place\") Again (# end)\n" +
+		"(# option \"Missing-place-2\") Other (# end)\n" +
+		"(# option \"the-end\") Home (# end)\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if imp.notes != 3 {
+		t.Errorf("got %d notes, want 3", imp.notes)
+	}
+}
@@ -19,7 +19,7 @@ func initialize(dir string) {
 		stop(fmt.Sprint(err))
 	}
 	defer fileHTML.Close()
-	fmt.Fprintln(fileHTML, gameHTML)
+	fmt.Fprint(fileHTML, gameHTML)
 	
 	fmt.Printf("Creating %s/%s\n", dir, SRC_JSON)
 	fileJSON, err := os.Create(path.Join(dir, SRC_JSON))
@@ -27,7 +27,7 @@ func initialize(dir string) {
 		stop(fmt.Sprint(err))
 	}
 	defer fileJSON.Close()
-	fmt.Fprintln(fileJSON, gameJSON)
+	fmt.Fprint(fileJSON, gameJSON)
 	
 	fmt.Printf("Creating %s/%s\n", dir, SRC_PASSAGES)
 	err = os.Mkdir(path.Join(dir, SRC_PASSAGES), 0755)
@@ -41,7 +41,7 @@ func initialize(dir string) {
 		stop(fmt.Sprint(err))
 	}
 	defer filePassage.Close()
-	fmt.Fprintln(filePassage, gamePassage)
+	fmt.Fprint(filePassage, gamePassage)
 	
 	fmt.Printf("Creating %s/%s\n", dir, SRC_ASSETS)
 	err = os.Mkdir(path.Join(dir, SRC_ASSETS), 0755)
@@ -90,6 +90,10 @@ const gameHTML = `<!DOCTYPE html>
           font-style: italic;
       }
 
+      .io-inactive-choice {
+          color: gray;
+      }
+
       .io-active-choice:hover { 
           text-decoration: underline;
       }
@@ -152,6 +156,7 @@ const gameJSON = `{
     "title": "Title",
     "subtitle": "Subtitle",
     "author": "Author",
+    "version": "0.1",
     "init": "start",
     "config": {
         "clear": true,
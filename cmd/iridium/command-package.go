@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Packages are zips of dist/ that portals can host as they are: the game
+// is index.html at the top. The same dist/ always gives the same zip, with
+// files in order and a fixed timestamp.
+
+const PACKAGE_ENTRY = "index.html"
+const PACKAGE_MANIFEST = "MANIFEST.sha256"
+
+// The earliest time a zip file can record.
+var packageTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var slugUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+var versionUnsafe = regexp.MustCompile(`[^A-Za-z0-9.]+`)
+
+// packageName makes a file name from the title and version of the game.
+func packageName(config GameConfig) string {
+	name := strings.Trim(slugUnsafe.ReplaceAllString(strings.ToLower(config.Title), "-"), "-")
+	if name == "" {
+		name = "game"
+	}
+	if config.Version != "" {
+		name += "-" + strings.Trim(versionUnsafe.ReplaceAllString(config.Version, "-"), "-")
+	}
+	return name + ".zip"
+}
+
+func packageCommand(args []string) {
+	flags := newFlags("package", "[--manifest] [--single-file] [--prune] [--out <file>] [<folder>]")
+	manifest := flags.Bool("manifest", false, "add a manifest of SHA-256 hashes of the files")
+	singleFile := flags.Bool("single-file", false, "build with assets inlined into the game")
+	prune := flags.Bool("prune", false, "build with only the assets that are referenced")
+	out := flags.String("out", "", "zip file to write (default named from the title and version, in the folder)")
+	srcdir := parseFolder(flags, args)
+
+	config, err := readConfig(srcdir)
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	build(srcdir, *singleFile, *prune)
+
+	zipFile := *out
+	if zipFile == "" {
+		zipFile = path.Join(srcdir, packageName(config))
+	}
+	fmt.Printf("Creating %s\n", zipFile)
+	if err := writePackage(path.Join(srcdir, GAME_DIST), zipFile, *manifest); err != nil {
+		os.Remove(zipFile)
+		stop(fmt.Sprint(err))
+	}
+}
+
+// listFiles lists the files of dir, as slash paths relative to it.
+func listFiles(dir string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func writePackage(dir string, zipFile string, manifest bool) error {
+	files, err := listFiles(dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(zipFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	add := func(name string, content []byte) error {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: packageTime}
+		header.SetMode(0644)
+		fw, err := w.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(content)
+		return err
+	}
+	hashes := make([]string, 0, len(files))
+	entries := make([]string, 0, len(files))
+	contents := make(map[string][]byte)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(path.Join(dir, file))
+		if err != nil {
+			return err
+		}
+		// The game goes in as the entry point.
+		if file == GAME_HTML {
+			file = PACKAGE_ENTRY
+		}
+		if _, ok := contents[file]; ok {
+			return fmt.Errorf("%s has both %s and %s", dir, GAME_HTML, PACKAGE_ENTRY)
+		}
+		entries = append(entries, file)
+		contents[file] = content
+	}
+	sort.Strings(entries)
+	for _, entry := range entries {
+		if err := add(entry, contents[entry]); err != nil {
+			return err
+		}
+		hashes = append(hashes, fmt.Sprintf("%x  %s\n", sha256.Sum256(contents[entry]), entry))
+	}
+	if manifest {
+		if err := add(PACKAGE_MANIFEST, []byte(strings.Join(hashes, ""))); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Packaged %d files\n", len(entries))
+	return f.Sync()
+}
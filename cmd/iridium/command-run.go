@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"os"
 	"path"
 	"strconv"
 	"strings"
@@ -31,6 +34,25 @@ type buffer struct {
 
 var buff = buffer{"", "", 0, true}
 
+// output is where passages are printed. iridium test captures it.
+var output io.Writer = os.Stdout
+
+// visibleLen is the width of s on the terminal, skipping ANSI escapes.
+func visibleLen(s string) int {
+	n := 0
+	inEscape := false
+	for _, ch := range s {
+		if inEscape {
+			inEscape = ch != 'm'
+		} else if ch == '\033' {
+			inEscape = true
+		} else {
+			n += 1
+		}
+	}
+	return n
+}
+
 func emitReset(indent int) {
 	buff.line = ""
 	buff.last = ""
@@ -47,8 +69,8 @@ func emitSpace() {
 	if buff.firstLine {
 		indent = buff.indent
 	}
-	if indent + len(buff.line) + len(buff.last) + 1 > maxWidth {
-		fmt.Println(buff.line)
+	if indent + visibleLen(buff.line) + visibleLen(buff.last) + 1 > maxWidth {
+		fmt.Fprintln(output, buff.line)
 		buff.line = strings.Repeat(" ", buff.indent) + buff.last + " "
 		buff.last = ""
 		buff.firstLine = false
@@ -63,30 +85,40 @@ func emitDone() {
 	if buff.firstLine {
 		indent = buff.indent
 	}
-	if indent + len(buff.line) + len(buff.last) + 1 > maxWidth {
-		fmt.Println(buff.line)
-		fmt.Println(buff.last)
+	if indent + visibleLen(buff.line) + visibleLen(buff.last) + 1 > maxWidth {
+		fmt.Fprintln(output, buff.line)
+		fmt.Fprintln(output, buff.last)
 	} else {
-		fmt.Println(buff.line + buff.last)
+		fmt.Fprintln(output, buff.line + buff.last)
 	}
 }
 
-func printTexts(content []Text) {
+func printTexts(content []Text, state State) {
 	for i, t := range(content) {
+		if i > 0 && !t.Glued {
+			emitSpace()
+		}
 		switch t.Kind {
 		case TEXT_WORD:
 			emitString(t.Word)
-			if i < len(content) - 1 {
-				emitSpace()
-			}
 
 		case TEXT_QUOTE:
 			emitString("\"")
-			printTexts(t.Content)
+			printTexts(t.Content, state)
 			emitString("\"")
-			if i < len(content) - 1 {
-				emitSpace()
-			}
+
+		case TEXT_EMPH:
+			emitString("\033[3m")
+			printTexts(t.Content, state)
+			emitString("\033[23m")
+
+		case TEXT_STRONG:
+			emitString("\033[1m")
+			printTexts(t.Content, state)
+			emitString("\033[22m")
+
+		case TEXT_SHOW:
+			emitString(showValue(t.Expr.eval(state)))
 			
 		default:
 			stop(fmt.Sprintf("Unknown Text kind %d", t.Kind))
@@ -94,8 +126,178 @@ func printTexts(content []Text) {
 	}
 }
 
+func printBlocks(blocks []Block, state State) {
+	for _, x := range(blocks) {
+		switch x.Kind {
+		case TEXT:
+			emitReset(0)
+			printTexts(x.Content, state)
+			emitDone()
+			fmt.Fprintln(output)
+
+		case IMAGE:
+			// Images are described by their alt text, or their caption.
+			description := x.Alt
+			if description == "" {
+				description = x.Caption
+			}
+			if description == "" {
+				description = path.Base(x.Image)
+			}
+			emitReset(0)
+			emitString("[image: " + description + "]")
+			emitDone()
+			fmt.Fprintln(output)
+
+		case SOUND, MUSIC, STOP_MUSIC:
+			cue := "[music stops]"
+			if x.Kind == SOUND {
+				cue = "[sound: " + path.Base(x.Sound) + "]"
+			} else if x.Kind == MUSIC && x.Loop {
+				cue = "[music: " + path.Base(x.Sound) + ", looping]"
+			} else if x.Kind == MUSIC {
+				cue = "[music: " + path.Base(x.Sound) + "]"
+			}
+			emitReset(0)
+			emitString(cue)
+			emitDone()
+			fmt.Fprintln(output)
+
+		case SET:
+			state[x.Var] = x.Expr.eval(state)
+
+		case COND:
+			if truthy(x.Expr.eval(state)) {
+				printBlocks(x.Then, state)
+			} else {
+				printBlocks(x.Else, state)
+			}
+		}
+	}
+}
+
+// onceKey names the state variable recording that the once option at
+// index was taken. It contains spaces, so it cannot clash with a story
+// variable. Options are told apart by target, and by their order among
+// the once options to the same target, so that adding or moving other
+// options keeps saved games and states meaning the same.
+func onceKey(passage string, options []Option, index int) string {
+	target := options[index].Target
+	nth := 0
+	for _, option := range options[:index] {
+		if option.Once && option.Target == target {
+			nth += 1
+		}
+	}
+	return fmt.Sprintf("taken \"%s\" \"%s\" %d", passage, target, nth)
+}
+
+// available reports whether the option is listed, and whether it can be
+// taken; key is its onceKey.
+func (o *Option) available(key string, state State) (bool, bool) {
+	if o.Cond != nil && !truthy(o.Cond.eval(state)) {
+		return o.Sticky, false
+	}
+	if o.Once && truthy(state[key]) {
+		return o.Sticky, false
+	}
+	return true, true
+}
+
+// A player keeps the state of a game being played in the terminal. The
+// state of a passage is kept as it was on entering the passage, before
+// its set annotations, so the passage can be shown again.
+type player struct {
+	passagesDir string
+	config GameConfig
+	passage string
+	state State
+	history []savedStep
+}
+
+func newPlayer(srcdir string, config GameConfig) *player {
+	p := &player{passagesDir: path.Join(srcdir, SRC_PASSAGES), config: config}
+	p.restart()
+	return p
+}
+
+func (p *player) restart() {
+	p.passage = p.config.InitialPassage
+	p.state = copyState(p.config.Global)
+	p.history = nil
+}
+
+// show prints the current passage and its options, and returns the
+// passage with the indices of the options that can be taken and the
+// state they see.
+func (p *player) show() (*Passage, []int, State, error) {
+	psg, err := parsePassage(p.passagesDir, p.passage)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	state := copyState(p.state)
+	printBlocks(psg.Blocks, state)
+	// choices holds the indices of the options that can be taken.
+	choices := make([]int, 0, len(psg.Options))
+	for i := range(psg.Options) {
+		option := &psg.Options[i]
+		listed, enabled := option.available(onceKey(p.passage, psg.Options, i), state)
+		if !listed {
+			continue
+		}
+		if enabled {
+			choices = append(choices, i)
+			fmt.Fprintf(output, " % 2d. ", len(choices))
+		} else {
+			fmt.Fprintf(output, "   -. ")
+		}
+		emitReset(5)
+		printTexts(option.Content, state)
+		emitDone()
+	}
+	return psg, choices, state, nil
+}
+
+// take follows option index of the current passage, given the state
+// after the passage was shown.
+func (p *player) take(psg *Passage, index int, state State) {
+	if psg.Options[index].Once {
+		state[onceKey(p.passage, psg.Options, index)] = true
+	}
+	p.history = append(p.history, savedStep{p.passage, p.state})
+	p.passage = psg.Options[index].Target
+	p.state = state
+}
+
+func (p *player) undo() bool {
+	if len(p.history) == 0 {
+		return false
+	}
+	last := p.history[len(p.history) - 1]
+	p.history = p.history[:len(p.history) - 1]
+	p.passage = last.Passage
+	p.state = last.State
+	return true
+}
+
+func copyState(state State) State {
+	result := State{}
+	for k, v := range state {
+		result[k] = v
+	}
+	return result
+}
+
+const runHelp = `Type the number of an option to take it, or one of:
+  save [<slot>]     save the game
+  restore [<slot>]  restore a saved game
+  undo              take back the last choice
+  restart           start over
+  look              show the passage again
+  history           list the passages so far
+  q                 quit`
+
 func run(srcdir string) {
-	passagesDir := path.Join(srcdir, SRC_PASSAGES)
 	config, err := readConfig(srcdir)
 	if err != nil {
 		stop(fmt.Sprint(err))
@@ -106,61 +308,106 @@ func run(srcdir string) {
 	fmt.Println("By", config.Author)
 	fmt.Println()
 
-	currentPassage := config.InitialPassage
-	for true {
-		passage, err := readPassage(passagesDir, currentPassage)
-		if err != nil {
-			stop(fmt.Sprint(err))
-		}
-		//fmt.Println(passage)
-		r := strings.NewReader(passage)
-		p := NewParser(r)
-		psg, err := p.Parse()
+	p := newPlayer(srcdir, config)
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		psg, choices, state, err := p.show()
 		if err != nil {
 			stop(fmt.Sprint(err))
 		}
-		for _, x := range(psg.Blocks) {
-			if x.Kind == TEXT {
-				emitReset(0)
-				printTexts(x.Content)
-				emitDone()
-				fmt.Println()
-			}
-		}
-		if len(psg.Options) > 0 {
-			for i, option := range(psg.Options) {
-				fmt.Printf(" % 2d. ", i + 1)
-				emitReset(5)
-				printTexts(option.Content)
-				emitDone()
-			}
-			fmt.Println()
-			var input string
-			for { 
-				fmt.Print("? ")
-				fmt.Scanln(&input)
-				if input == "q" {
+		fmt.Println()
+		for {
+			fmt.Print("? ")
+			line, err := reader.ReadString('\n')
+			words := strings.Fields(line)
+			if (err == io.EOF && len(words) == 0) || (len(words) == 1 && words[0] == "q") {
+				if err == io.EOF {
+					fmt.Println()
+				}
+				if len(choices) > 0 {
 					fmt.Println("Bailing")
-					return
 				}
-				if input == "" && len(psg.Options) == 1 {
+				return
+			}
+			if len(words) == 0 {
+				if len(choices) == 1 {
 					// one choice, so take it
-					currentPassage = psg.Options[0].Target
+					p.take(psg, choices[0], state)
 					break
 				}
-				choice, err := strconv.Atoi(input)
-				if err == nil && choice > 0 && choice <= len(psg.Options) {
-					currentPassage = psg.Options[choice - 1].Target
+				continue
+			}
+			if choice, err := strconv.Atoi(words[0]); err == nil && len(words) == 1 {
+				if choice > 0 && choice <= len(choices) {
+					p.take(psg, choices[choice - 1], state)
 					break
 				}
+				fmt.Println("No such option")
+				continue
+			}
+			if p.command(srcdir, words) {
+				break
 			}
-			clear()
-			continue
 		}
-		break
+		clear()
 	}
 }
 
+// command runs a meta-command, and reports whether the passage needs
+// to be shown again.
+func (p *player) command(srcdir string, words []string) bool {
+	slot := defaultSlot
+	if len(words) > 2 {
+		fmt.Println("Too many arguments, type help for commands")
+		return false
+	}
+	if len(words) == 2 {
+		slot = words[1]
+	}
+	switch words[0] {
+	case "save":
+		file, err := p.save(srcdir, slot)
+		if err != nil {
+			fmt.Println("Cannot save:", err)
+		} else {
+			fmt.Println("Saved to", file)
+		}
+
+	case "restore":
+		if err := p.restore(srcdir, slot); err != nil {
+			fmt.Println("Cannot restore:", err)
+			return false
+		}
+		return true
+
+	case "undo":
+		if !p.undo() {
+			fmt.Println("Nothing to undo")
+			return false
+		}
+		return true
+
+	case "restart":
+		p.restart()
+		return true
+
+	case "look":
+		return true
+
+	case "history":
+		for i, step := range p.history {
+			fmt.Printf(" % 2d. %s\n", i + 1, step.Passage)
+		}
+		fmt.Printf(" % 2d. %s (here)\n", len(p.history) + 1, p.passage)
+
+	case "help":
+		fmt.Println(runHelp)
+
+	default:
+		fmt.Println("Unknown command, type help for commands")
+	}
+	return false
+}
 
 func clear() {
 	fmt.Print("\033[H\033[2J\n")
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOnceKey(t *testing.T) {
+	before := `(# option "shop" once) Buy (# end)
+(# option "shop" once) Buy more (# end)`
+	after := `(# option "home") Home (# end)
+(# option "shop" once) Buy (# end)
+(# option "cave" once) Explore (# end)
+(# option "shop" once) Buy more (# end)`
+	keys := func(text string) map[string]string {
+		psg, err := NewParser(strings.NewReader(text)).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[string]string)
+		for i, option := range psg.Options {
+			if option.Once {
+				result[plainText(option.Content)] = onceKey("start", psg.Options, i)
+			}
+		}
+		return result
+	}
+	old, inserted := keys(before), keys(after)
+	if old["Buy"] == old["Buy more"] {
+		t.Errorf("got the same key %s for two options", old["Buy"])
+	}
+	for content, key := range old {
+		if inserted[content] != key {
+			t.Errorf("%s: got key %s after inserting options, want %s", content, inserted[content], key)
+		}
+	}
+	if want := `taken "start" "shop" 1`; old["Buy more"] != want {
+		t.Errorf("got key %s, want %s", old["Buy more"], want)
+	}
+}
+
+func TestAvailable(t *testing.T) {
+	psg, err := NewParser(strings.NewReader(`(# option "a" if gold) Rich (# end)
+(# option "b" once) Once (# end)
+(# option "c" once sticky) Sticky (# end)`)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		state State
+		listed []bool
+		takable []bool
+	}{
+		{State{}, []bool{false, true, true}, []bool{false, true, true}},
+		{State{"gold": 1.0, onceKey("p", psg.Options, 1): true, onceKey("p", psg.Options, 2): true}, []bool{true, false, true}, []bool{true, false, false}},
+	}
+	for _, test := range tests {
+		for i := range psg.Options {
+			listed, takable := psg.Options[i].available(onceKey("p", psg.Options, i), test.state)
+			if listed != test.listed[i] || takable != test.takable[i] {
+				t.Errorf("option %d in %v: got %t %t, want %t %t", i, test.state, listed, takable, test.listed[i], test.takable[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Statistics are computed on the graph of options, ignoring conditions,
+// like the reachability checks of iridium check. Playthroughs are the
+// paths from the initial passage to an ending that do not go through a
+// passage twice; there can be a great many, so the search for them only
+// visits passages up to a limit, which also bounds it on cyclic graphs.
+
+const wordsPerMinute = 200
+
+type passageStats struct {
+	Name string `json:"name"`
+	Words int `json:"words"`
+	Options int `json:"options"`
+	Reachable bool `json:"reachable"`
+}
+
+type endingStats struct {
+	Name string `json:"name"`
+	Reachable bool `json:"reachable"`
+	// Paths are lists of passages, from the initial one to the ending.
+	Shortest []string `json:"shortest,omitempty"`
+	Longest []string `json:"longest,omitempty"`
+}
+
+type storyStats struct {
+	Passages []passageStats `json:"passages"`
+	Words int `json:"words"`
+	ReadingMinutes float64 `json:"readingMinutes"`
+	Endings []endingStats `json:"endings"`
+	// Branching is the average number of options of the reachable
+	// passages that are not endings.
+	Branching float64 `json:"branching"`
+	MaxBranching int `json:"maxBranching"`
+	Playthroughs int `json:"playthroughs"`
+	// Set when counting stopped at the limit, in which case
+	// the longest paths are only the longest found.
+	PlaythroughsCapped bool `json:"playthroughsCapped,omitempty"`
+}
+
+// countWords counts the words of text. Punctuation glued to a word is
+// part of the word; interpolations count as one word.
+func countWords(items []Text) int {
+	n := 0
+	for i, item := range items {
+		switch item.Kind {
+		case TEXT_WORD:
+			if !(i > 0 && item.Glued) && strings.IndexFunc(item.Word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 {
+				n += 1
+			}
+		case TEXT_QUOTE, TEXT_EMPH, TEXT_STRONG:
+			n += countWords(item.Content)
+		case TEXT_SHOW:
+			n += 1
+		}
+	}
+	return n
+}
+
+func passageWords(psg *Passage) int {
+	n := 0
+	walkBlocks(psg.Blocks, func(b *Block) {
+		if b.Kind == TEXT {
+			n += countWords(b.Content)
+		}
+	})
+	for _, option := range psg.Options {
+		n += countWords(option.Content)
+	}
+	return n
+}
+
+// shortestPaths finds the shortest path from the initial passage to every
+// reachable passage.
+func shortestPaths(story *Story) map[string][]string {
+	paths := make(map[string][]string)
+	initial := story.Config.InitialPassage
+	if _, ok := story.Passages[initial]; !ok {
+		return paths
+	}
+	paths[initial] = []string{initial}
+	queue := []string{initial}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, option := range story.Passages[name].Options {
+			if _, seen := paths[option.Target]; seen {
+				continue
+			}
+			if _, ok := story.Passages[option.Target]; !ok {
+				continue
+			}
+			paths[option.Target] = append(append([]string{}, paths[name]...), option.Target)
+			queue = append(queue, option.Target)
+		}
+	}
+	return paths
+}
+
+type playthroughs struct {
+	story *Story
+	// Passages visited so far, against the limit.
+	limit int
+	visited int
+	count int
+	capped bool
+	longest map[string][]string
+	path []string
+	onPath map[string]bool
+}
+
+func (p *playthroughs) walk(name string) {
+	psg, ok := p.story.Passages[name]
+	if !ok || p.capped {
+		return
+	}
+	if p.visited >= p.limit {
+		p.capped = true
+		return
+	}
+	p.visited += 1
+	p.path = append(p.path, name)
+	p.onPath[name] = true
+	if len(psg.Options) == 0 {
+		p.count += 1
+		if len(p.path) > len(p.longest[name]) {
+			p.longest[name] = append([]string{}, p.path...)
+		}
+	}
+	for _, option := range psg.Options {
+		if !p.onPath[option.Target] {
+			p.walk(option.Target)
+		}
+	}
+	p.onPath[name] = false
+	p.path = p.path[:len(p.path) - 1]
+}
+
+func storyStatistics(story *Story, limit int) *storyStats {
+	stats := &storyStats{Passages: make([]passageStats, 0), Endings: make([]endingStats, 0)}
+	reachable := story.reachable()
+	shortest := shortestPaths(story)
+	p := &playthroughs{story: story, limit: limit, longest: make(map[string][]string), onPath: make(map[string]bool)}
+	p.walk(story.Config.InitialPassage)
+	stats.Playthroughs = p.count
+	stats.PlaythroughsCapped = p.capped
+
+	branching := 0
+	branchingPassages := 0
+	for _, name := range story.Names {
+		psg, ok := story.Passages[name]
+		if !ok {
+			continue
+		}
+		words := passageWords(psg)
+		stats.Passages = append(stats.Passages, passageStats{name, words, len(psg.Options), reachable[name]})
+		stats.Words += words
+		if len(psg.Options) == 0 {
+			stats.Endings = append(stats.Endings, endingStats{name, reachable[name], shortest[name], p.longest[name]})
+		} else if reachable[name] {
+			branching += len(psg.Options)
+			branchingPassages += 1
+			if len(psg.Options) > stats.MaxBranching {
+				stats.MaxBranching = len(psg.Options)
+			}
+		}
+	}
+	stats.ReadingMinutes = math.Round(float64(stats.Words) / wordsPerMinute * 10) / 10
+	if branchingPassages > 0 {
+		stats.Branching = math.Round(float64(branching) / float64(branchingPassages) * 100) / 100
+	}
+	return stats
+}
+
+func statsCommand(args []string) {
+	flags := newFlags("stats", "[--format table|json] [--limit <n>] [<folder>]")
+	format := flags.String("format", "table", "output format: table or json")
+	limit := flags.Int("limit", 1000000, "most passages to visit when counting playthroughs")
+	srcdir := parseFolder(flags, args)
+
+	story, err := loadStory(srcdir)
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	for _, e := range story.Errors {
+		fmt.Fprintln(os.Stderr, e)
+	}
+	stats := storyStatistics(story, *limit)
+	switch *format {
+	case "table":
+		printStats(stats)
+	case "json":
+		j, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			stop(fmt.Sprint(err))
+		}
+		fmt.Println(string(j))
+	default:
+		stop(fmt.Sprintf("Unknown stats format: %s", *format))
+	}
+}
+
+// pathSteps is the number of choices along a path.
+func pathSteps(path []string) string {
+	if len(path) == 2 {
+		return "1 step"
+	}
+	return fmt.Sprintf("%d steps", len(path) - 1)
+}
+
+func printStats(stats *storyStats) {
+	width := len("Passage")
+	for _, p := range stats.Passages {
+		if len(p.Name) > width {
+			width = len(p.Name)
+		}
+	}
+	fmt.Printf("%-*s %7s %7s\n", width, "Passage", "Words", "Options")
+	for _, p := range stats.Passages {
+		note := ""
+		if !p.Reachable {
+			note = "  (unreachable)"
+		}
+		fmt.Printf("%-*s %7d %7d%s\n", width, p.Name, p.Words, p.Options, note)
+	}
+	fmt.Printf("%-*s %7d\n", width, "Total", stats.Words)
+	fmt.Println()
+	fmt.Printf("Reading time: about %.1f minutes at %d words per minute\n", stats.ReadingMinutes, wordsPerMinute)
+	fmt.Printf("Branching factor: %.2f options per passage, at most %d\n", stats.Branching, stats.MaxBranching)
+	if stats.PlaythroughsCapped {
+		fmt.Printf("Playthroughs: at least %d\n", stats.Playthroughs)
+	} else {
+		fmt.Printf("Playthroughs: %d\n", stats.Playthroughs)
+	}
+	fmt.Printf("Endings: %d\n", len(stats.Endings))
+	for _, e := range stats.Endings {
+		if !e.Reachable {
+			fmt.Printf("  %s: unreachable\n", e.Name)
+			continue
+		}
+		fmt.Printf("  %s\n", e.Name)
+		fmt.Printf("    shortest, %s: %s\n", pathSteps(e.Shortest), strings.Join(e.Shortest, " > "))
+		longest := "longest"
+		if stats.PlaythroughsCapped {
+			longest = "longest found"
+		}
+		if e.Longest != nil {
+			fmt.Printf("    %s, %s: %s\n", longest, pathSteps(e.Longest), strings.Join(e.Longest, " > "))
+		}
+	}
+}
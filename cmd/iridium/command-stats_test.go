@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPassageWords(t *testing.T) {
+	tests := []struct {
+		text string
+		words int
+	}{
+		{"One two three.", 3},
+		{"One two three.\n\nShe said \"hello there friend\" loudly.", 9},
+		{"(+em Leading) word and (+strong two words).", 5},
+		{"Gold: (+show gold) coins.", 3},
+		{"gold(+show gold) and \"quoted\"word.", 4},
+		{"-- and ... are not words.", 4},
+		{"Text.\n\n(# option \"next\") Go on (# end)", 3},
+	}
+	for _, test := range tests {
+		psg, err := NewParser(strings.NewReader(test.text)).Parse()
+		if err != nil {
+			t.Errorf("%q: %v", test.text, err)
+			continue
+		}
+		if words := passageWords(psg); words != test.words {
+			t.Errorf("%q: got %d words, want %d", test.text, words, test.words)
+		}
+	}
+}
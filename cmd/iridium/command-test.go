@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Walkthroughs live in the walkthroughs folder of a game, one per .txt
+// file. Each is played from the start of the game, one line at a time:
+//
+//   # a comment
+//   choose 2             take the second option that can be taken
+//   choose Open the door take the option with that text
+//   passage hall         the current passage is hall
+//   see a locked door    the passage or its options show that text
+//   not-see a key        they do not
+//   state gold 10        a state variable has a value, written as JSON
+//   ending               the passage has no options to take
+//
+// Text is compared with spaces normalized and markup removed. A failed
+// assertion is reported and the walkthrough goes on; a choice that cannot
+// be made ends it.
+
+type walkthrough struct {
+	file string
+	p *player
+	step int
+	failures int
+	// What the current passage shows, and the options that can be taken
+	// with their text.
+	psg *Passage
+	shown string
+	choices []int
+	labels []string
+	state State
+}
+
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// capture returns what f prints, without markup and with spaces
+// normalized.
+func capture(f func()) string {
+	var b bytes.Buffer
+	saved := output
+	output = &b
+	f()
+	output = saved
+	return strings.Join(strings.Fields(ansiEscape.ReplaceAllString(b.String(), "")), " ")
+}
+
+func (w *walkthrough) failf(line int, format string, args ...interface{}) {
+	w.failures += 1
+	fmt.Printf("%s:%d: step %d in passage %s: %s\n", w.file, line, w.step, w.p.passage, fmt.Sprintf(format, args...))
+}
+
+// enter shows the current passage, headlessly.
+func (w *walkthrough) enter() error {
+	var err error
+	w.shown = capture(func() {
+		w.psg, w.choices, w.state, err = w.p.show()
+	})
+	if err != nil {
+		return err
+	}
+	w.labels = make([]string, len(w.choices))
+	for i, index := range w.choices {
+		w.labels[i] = capture(func() {
+			emitReset(0)
+			printTexts(w.psg.Options[index].Content, w.state)
+			emitDone()
+		})
+	}
+	return nil
+}
+
+// choose finds the option to take, by number or by text.
+func (w *walkthrough) choose(what string) (int, bool) {
+	if n, err := strconv.Atoi(what); err == nil {
+		if n > 0 && n <= len(w.choices) {
+			return w.choices[n - 1], true
+		}
+		return 0, false
+	}
+	what = strings.Join(strings.Fields(what), " ")
+	for i, label := range w.labels {
+		if strings.EqualFold(label, what) {
+			return w.choices[i], true
+		}
+	}
+	return 0, false
+}
+
+// play runs a walkthrough, and returns false when it had to stop early.
+func (w *walkthrough) play(lines []string) bool {
+	if err := w.enter(); err != nil {
+		w.failf(1, "%s", err)
+		return false
+	}
+	for i, line := range lines {
+		lineNo := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		w.step += 1
+		command, arg := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			command, arg = line[:i], strings.TrimSpace(line[i:])
+		}
+		switch command {
+		case "choose":
+			index, ok := w.choose(arg)
+			if !ok {
+				w.failf(lineNo, "No option %s among %s", arg, quoteLabels(w.labels))
+				return false
+			}
+			w.p.take(w.psg, index, w.state)
+			if err := w.enter(); err != nil {
+				w.failf(lineNo, "%s", err)
+				return false
+			}
+
+		case "passage":
+			if w.p.passage != arg {
+				w.failf(lineNo, "Expected passage %s", arg)
+			}
+
+		case "see", "not-see":
+			text := strings.Join(strings.Fields(arg), " ")
+			if strings.Contains(w.shown, text) != (command == "see") {
+				if command == "see" {
+					w.failf(lineNo, "Text %q not shown", text)
+				} else {
+					w.failf(lineNo, "Text %q shown", text)
+				}
+			}
+
+		case "state":
+			fields := strings.SplitN(arg, " ", 2)
+			if len(fields) != 2 {
+				w.failf(lineNo, "Expected state <variable> <value>")
+				continue
+			}
+			var expected interface{}
+			if err := json.Unmarshal([]byte(fields[1]), &expected); err != nil {
+				w.failf(lineNo, "Bad value %s: %s", fields[1], err)
+				continue
+			}
+			if actual := w.state[fields[0]]; !equalValues(actual, expected) {
+				j, _ := json.Marshal(actual)
+				w.failf(lineNo, "Expected %s to be %s, got %s", fields[0], fields[1], j)
+			}
+
+		case "ending":
+			if len(w.choices) > 0 {
+				w.failf(lineNo, "Expected an ending, got options %s", quoteLabels(w.labels))
+			}
+
+		default:
+			w.failf(lineNo, "Unknown walkthrough command %s", command)
+			return false
+		}
+	}
+	return true
+}
+
+func quoteLabels(labels []string) string {
+	quoted := make([]string, len(labels))
+	for i, label := range labels {
+		quoted[i] = fmt.Sprintf("%d %q", i + 1, label)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func readLines(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+func test(srcdir string) {
+	config, err := readConfig(srcdir)
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	dir := path.Join(srcdir, SRC_WALKTHROUGHS)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		stop(fmt.Sprint(err))
+	}
+	count := 0
+	failed := 0
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".txt") {
+			continue
+		}
+		file := path.Join(dir, f.Name())
+		lines, err := readLines(file)
+		if err != nil {
+			stop(fmt.Sprint(err))
+		}
+		count += 1
+		w := &walkthrough{file: file, p: newPlayer(srcdir, config)}
+		finished := w.play(lines)
+		if w.failures > 0 {
+			failed += 1
+			if !finished {
+				fmt.Printf("%s: stopped at step %d\n", file, w.step)
+			}
+		} else {
+			fmt.Printf("%s: ok, %d steps\n", file, w.step)
+		}
+	}
+	fmt.Printf("%d walkthroughs, %d failed\n", count, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"path"
 	"encoding/json"
 	"io/ioutil"
+	"regexp"
 )
 
 type GameConfig struct {
@@ -12,6 +13,10 @@ type GameConfig struct {
 	Subtitle string
 	Author string
 	InitialPassage string `json:"init"`
+	Version string
+	// The IFID identifies the story to Twine and to archives.
+	IFID string `json:"ifid"`
+	Global State
 }
 
 func readConfig(srcdir string) (GameConfig, error) {
@@ -26,3 +31,18 @@ func readConfig(srcdir string) (GameConfig, error) {
 	//fmt.Println("json = ", config)
 	return config, nil
 }
+
+// renameInitialPassage points game.json to the new name of the initial
+// passage, leaving the rest of the file as it is.
+func renameInitialPassage(srcdir string, from string, to string) error {
+	file := path.Join(srcdir, SRC_JSON)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	init := regexp.MustCompile(`("init"\s*:\s*)"` + regexp.QuoteMeta(from) + `"`)
+	renamed := init.ReplaceAllStringFunc(string(content), func(s string) string {
+		return init.FindStringSubmatch(s)[1] + "\"" + to + "\""
+	})
+	return writeFileAtomic(file, []byte(renamed), 0644)
+}
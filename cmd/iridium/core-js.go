@@ -21,6 +21,7 @@ func dumpCoreJS(out io.Writer) {
  * .io-splash  (h1 splash, h2 subtitle, h3 author)
  * .io-clear   (hr when clearing))
  * .io-title   (t)
+ * .io-inactive-choice  (option that cannot be taken)
  * 
  */
 
@@ -90,16 +91,24 @@ function scroll (addr) {
 }
 
 
+// The title, subtitle and author are text, not markup.
 function splash (txt,subtxt,author) { 
     _addr = 0;
-    var content = "<h1 class=\"io-splash\" id=\"io-addr0\">"+txt+"</h1>";
+    $(_id).innerHTML = "";
+    const heading = function (tag, text) {
+	const h = ce(tag);
+	h.classList.add("io-splash");
+	h.textContent = text;
+	$(_id).appendChild(h);
+	return h;
+    };
+    heading("h1", txt).setAttribute("id", "io-addr0");
     if (subtxt) { 
-	content += "<h2 class=\"io-splash\">"+subtxt+"</h2>";
+	heading("h2", subtxt);
     }
     if (author) { 
-	content += "<h3 class=\"io-splash\">By "+author+"</h3>";
+	heading("h3", "By " + author);
     }
-    $(_id).innerHTML = content;
     return this;
 }
 
@@ -125,7 +134,7 @@ function newp (cl_flag) {
 function t (text) {
     const h3 = ce("h3")
     h3.classList.add("io-title");
-    h3.innerText = text;
+    h3.innerHTML = text;
     $(_id).appendChild(h3);
     return this;
 }
@@ -171,17 +180,94 @@ function p_class (cl) {
 }
 
 
-function img (src,style) {
+// Images get alt text, empty for decorative ones, and go in a figure
+// when they have a caption.
+function img (src, style, options) {
+    options = options || {};
+    const img = ce("img");
+    img.setAttribute("src", src);
+    img.setAttribute("alt", options.alt || "");
+    if (options.width) {
+        style = "width: " + options.width + ";" + (style ? " " + style : "");
+    }
     if (style) {
-        const img = ce("img");
-	img.setAttribute("src", src);
         img.setAttribute("style", style);
-        $(_id).appendChild(img);
-    } else { 
-        const img = ce("img");
-	img.setAttribute("src", src);
-        $(_id).appendChild(img);
     }
+    let elt = img;
+    if (options.caption) {
+        elt = ce("figure");
+        elt.appendChild(img);
+        const caption = ce("figcaption");
+        caption.textContent = options.caption;
+        elt.appendChild(caption);
+    }
+    if (options["class"]) {
+        elt.setAttribute("class", options["class"]);
+    }
+    $(_id).appendChild(elt);
+    return this;
+}
+
+// Browsers only play sound once the player has interacted with the page.
+// Sounds that cannot play yet are dropped, since they belong to the
+// moment; music waits for the first click or key press. Music keeps
+// playing across passages, and asking again for the track that is
+// playing leaves it alone.
+var _music = null;
+var _musicSrc = null;
+var _musicBlocked = false;
+
+function playAudio (audio, onBlocked) {
+    const playing = audio.play();
+    if (playing && playing.catch) {
+	playing.catch(function(err) {
+	    if (err.name === "NotAllowedError" && onBlocked) {
+		onBlocked();
+	    }
+	});
+    }
+}
+
+function unblockMusic () {
+    if (_music && _musicBlocked) {
+	_musicBlocked = false;
+	playAudio(_music, null);
+    }
+}
+
+document.addEventListener("click", unblockMusic);
+document.addEventListener("keydown", unblockMusic);
+
+function sound (src) {
+    playAudio(new Audio(src), null);
+    return this;
+}
+
+function music (src, loop) {
+    if (_music && _musicSrc === src) {
+	_music.loop = loop;
+	return this;
+    }
+    stopMusic();
+    const audio = new Audio(src);
+    audio.loop = loop;
+    _music = audio;
+    _musicSrc = src;
+    playAudio(audio, function() {
+	if (_music === audio) {
+	    _musicBlocked = true;
+	}
+    });
+    return this;
+}
+
+function stopMusic () {
+    if (_music) {
+	_music.pause();
+    }
+    _music = null;
+    _musicSrc = null;
+    _musicBlocked = false;
     return this;
 }
 
@@ -324,6 +410,7 @@ function choices () {
                     li.appendChild(span);
 		} else {
                     const span = ce("span");
+                    span.classList.add("io-inactive-choice");
                     span.innerHTML = "<span><span class=\"show-if-selected\">" + group_name + "</span> " + opt.text + "</span>";
                     li.appendChild(span);
 		}
@@ -351,6 +438,9 @@ const io = {}
 io.config = config;
 io.splash = splash;
 io.img = img;
+io.sound = sound;
+io.music = music;
+io.stopMusic = stopMusic;
 io.t = t;
 io.p = p;
 io.ps = ps;
@@ -368,7 +458,7 @@ function run(game, content)  {
     let title = game.title;
     let subtitle = game.subtitle;
     let author = game.author;
-    let state= game.global;
+    let state= game.global || {};
     let passage = game.init;
     let closed_content = content();
     io.config(config);
@@ -389,8 +479,112 @@ function goPassage (state, content, key, clear) {
     }
 }
 
+
+/*
+ * Story state: values are null, numbers, strings or booleans.
+ * Must agree with the evaluator in expr.go.
+ */
+
+function get (state, key) { 
+    return Object.prototype.hasOwnProperty.call(state, key) ? state[key] : null;
+}
+
+function truthy (v) { 
+    return v !== null && v !== undefined && v !== false && v !== 0 && v !== "" && !Number.isNaN(v);
+}
+
+function show (v) { 
+    if (v === null || v === undefined) {
+	return "";
+    }
+    return String(v);
+}
+
+function escape (s) { 
+    return s.replace(/&/g, "&amp;")
+	.replace(/</g, "&lt;")
+	.replace(/>/g, "&gt;")
+	.replace(/"/g, "&#34;")
+	.replace(/'/g, "&#39;");
+}
+
+function num (v) { 
+    if (typeof v === "number") {
+	return v;
+    }
+    if (typeof v === "boolean") {
+	return v ? 1 : 0;
+    }
+    if (typeof v === "string") {
+	const n = Number(v.trim());
+	return (v.trim() === "" || Number.isNaN(n)) ? 0 : n;
+    }
+    return 0;
+}
+
+function compare (a, b) { 
+    if (typeof a === "string" && typeof b === "string") {
+	return a < b ? -1 : (a > b ? 1 : 0);
+    }
+    const x = num(a), y = num(b);
+    return x < y ? -1 : (x > y ? 1 : 0);
+}
+
+function op (name, ...args) { 
+    switch (name) {
+    case "+":
+	if (args.some(a => typeof a === "string")) {
+	    return args.map(show).join("");
+	}
+	return args.reduce((acc, a) => acc + num(a), 0);
+    case "-":
+	if (args.length === 1) {
+	    return -num(args[0]);
+	}
+	return args.slice(1).reduce((acc, a) => acc - num(a), num(args[0]));
+    case "*":
+	return args.reduce((acc, a) => acc * num(a), 1);
+    case "/":
+	return args.slice(1).reduce((acc, a) => acc / num(a), num(args[0]));
+    case "=":
+	return args[0] === args[1];
+    case "!=":
+	return args[0] !== args[1];
+    case "<":
+	return compare(args[0], args[1]) < 0;
+    case ">":
+	return compare(args[0], args[1]) > 0;
+    case "<=":
+	return compare(args[0], args[1]) <= 0;
+    case ">=":
+	return compare(args[0], args[1]) >= 0;
+    case "and":
+	for (const a of args) {
+	    if (!truthy(a)) {
+		return a;
+	    }
+	}
+	return args[args.length - 1];
+    case "or":
+	for (const a of args) {
+	    if (truthy(a)) {
+		return a;
+	    }
+	}
+	return args[args.length - 1];
+    case "not":
+	return !truthy(args[0]);
+    }
+    return null;
+}
+
 const engine = {}
 engine.goPassage = goPassage;
 engine.run = run;
+engine.get = get;
+engine.truthy = truthy;
+engine.show = show;
+engine.escape = escape;
+engine.op = op;
     `)
 }
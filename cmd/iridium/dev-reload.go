@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The dev server watches the game sources and tells the browser about
+// changes through Server-Sent Events. Watching is done by polling, which
+// needs no platform support and is plenty fast for a handful of files.
+
+const watchInterval = 500 * time.Millisecond
+
+type fileStamp struct {
+	modTime time.Time
+	size int64
+}
+
+// devChange is sent to the browser. Changes to game.html or game.json need
+// the page reloaded; changes to passages or assets only a re-render.
+type devChange struct {
+	Files []string `json:"files"`
+	Reload bool `json:"reload"`
+}
+
+type devEvents struct {
+	mu sync.Mutex
+	clients map[chan devChange]bool
+}
+
+func newDevEvents() *devEvents {
+	return &devEvents{clients: make(map[chan devChange]bool)}
+}
+
+func (e *devEvents) subscribe() chan devChange {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ch := make(chan devChange, 8)
+	e.clients[ch] = true
+	return ch
+}
+
+func (e *devEvents) unsubscribe(ch chan devChange) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.clients, ch)
+}
+
+func (e *devEvents) publish(change devChange) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.clients {
+		select {
+		case ch <- change:
+		default:
+			// A client that is not keeping up will catch up on the next change.
+		}
+	}
+}
+
+func eventsHandler(events *devEvents) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "500 internal error.", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		ch := events.subscribe()
+		defer events.unsubscribe(ch)
+		fmt.Fprint(w, ": watching\n\n")
+		flusher.Flush()
+		for {
+			select {
+			case change := <-ch:
+				j, _ := json.Marshal(change)
+				fmt.Fprintf(w, "event: change\ndata: %s\n\n", j)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// snapshotFiles stamps the files the dev server serves from srcdir.
+func snapshotFiles(srcdir string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	add := func(file string, info os.FileInfo) {
+		rel, err := filepath.Rel(srcdir, file)
+		if err != nil {
+			rel = file
+		}
+		stamps[filepath.ToSlash(rel)] = fileStamp{info.ModTime(), info.Size()}
+	}
+	for _, name := range []string{SRC_JSON, SRC_HTML} {
+		if info, err := os.Stat(path.Join(srcdir, name)); err == nil {
+			add(path.Join(srcdir, name), info)
+		}
+	}
+	for _, dir := range []string{SRC_PASSAGES, SRC_ASSETS} {
+		filepath.Walk(path.Join(srcdir, dir), func(file string, info os.FileInfo, err error) error {
+			// Hidden files are editor backups and files being written.
+			if err == nil && info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+				add(file, info)
+			}
+			return nil
+		})
+	}
+	return stamps
+}
+
+func watchFiles(srcdir string, events *devEvents) {
+	previous := snapshotFiles(srcdir)
+	for {
+		time.Sleep(watchInterval)
+		current := snapshotFiles(srcdir)
+		change := devChange{Files: make([]string, 0)}
+		for file, stamp := range current {
+			if old, ok := previous[file]; !ok || old != stamp {
+				change.Files = append(change.Files, file)
+			}
+		}
+		for file := range previous {
+			if _, ok := current[file]; !ok {
+				change.Files = append(change.Files, file)
+			}
+		}
+		previous = current
+		if len(change.Files) == 0 {
+			continue
+		}
+		sort.Strings(change.Files)
+		for _, file := range change.Files {
+			if file == SRC_JSON || file == SRC_HTML {
+				change.Reload = true
+			}
+		}
+		log.Println("Changed", change.Files)
+		events.publish(change)
+	}
+}
+
+// noCache makes the browser revalidate assets, so edited images show up
+// when a passage is re-rendered.
+func noCache(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		h.ServeHTTP(w, r)
+	})
+}
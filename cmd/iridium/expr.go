@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+   Expressions are used by (# set ...) and (# if ...) annotations and by
+   (+show ...) interpolations. They are written as s-expressions:
+
+     42  "a string"  true  false  has-key  (+ gold 10)  (not has-key)
+
+   Any other symbol is a variable of the story state. The evaluator below
+   and the runtime in core-js.go must agree on the semantics.
+*/
+
+type ExprKind int
+
+const (
+	EXPR_NUMBER ExprKind = iota
+	EXPR_STRING
+	EXPR_BOOL
+	EXPR_VAR
+	EXPR_CALL
+)
+
+type Expr struct {
+	Kind ExprKind
+	Value string
+	Args []Expr
+}
+
+// State maps story variables to values: nil, float64, string or bool.
+type State map[string]interface{}
+
+// Minimum number of arguments of each operator, and maximum (-1 if none).
+var operators = map[string][2]int{
+	"+":   {1, -1},
+	"-":   {1, -1},
+	"*":   {1, -1},
+	"/":   {2, -1},
+	"=":   {2, 2},
+	"!=":  {2, 2},
+	"<":   {2, 2},
+	">":   {2, 2},
+	"<=":  {2, 2},
+	">=":  {2, 2},
+	"and": {1, -1},
+	"or":  {1, -1},
+	"not": {1, 1},
+}
+
+func newExpr(s *SExp) (*Expr, error) {
+	if s == nil {
+		return nil, fmt.Errorf("Missing expression")
+	}
+	switch s.kind {
+	case T_STRING:
+		return &Expr{Kind: EXPR_STRING, Value: s.value}, nil
+	case T_SYMBOL:
+		if isVariable(s.value) {
+			return &Expr{Kind: EXPR_VAR, Value: s.value}, nil
+		}
+		if isNumber(s.value) {
+			return &Expr{Kind: EXPR_NUMBER, Value: s.value}, nil
+		}
+		return &Expr{Kind: EXPR_BOOL, Value: s.value}, nil
+	case T_CONS:
+		if !s.car.isSymbol() {
+			return nil, fmt.Errorf("Expected an operator in %s", s.str())
+		}
+		op := s.car.value
+		arity, ok := operators[op]
+		if !ok {
+			return nil, fmt.Errorf("Unknown operator %s", op)
+		}
+		n := s.length() - 1
+		if n < arity[0] || (arity[1] >= 0 && n > arity[1]) {
+			return nil, fmt.Errorf("Wrong number of arguments to %s", op)
+		}
+		args := make([]Expr, 0, n)
+		for i := 1; i <= n; i++ {
+			arg, err := newExpr(s.index(i))
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, *arg)
+		}
+		return &Expr{Kind: EXPR_CALL, Value: op, Args: args}, nil
+	}
+	return nil, fmt.Errorf("Illegal expression %s", s.str())
+}
+
+// isNumber rejects the names ParseFloat accepts (inf, nan), which are
+// perfectly good variable names.
+func isNumber(s string) bool {
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return false
+	}
+	return strings.ContainsAny(s, "0123456789")
+}
+
+// String writes the expression back as an s-expression.
+func (e *Expr) String() string {
+	switch e.Kind {
+	case EXPR_STRING:
+		return "\"" + e.Value + "\""
+	case EXPR_CALL:
+		args := make([]string, 0, len(e.Args) + 1)
+		args = append(args, e.Value)
+		for i := range e.Args {
+			args = append(args, e.Args[i].String())
+		}
+		return "(" + strings.Join(args, " ") + ")"
+	}
+	return e.Value
+}
+
+func isVariable(s string) bool {
+	return s != "true" && s != "false" && !isNumber(s)
+}
+
+func (e *Expr) eval(state State) interface{} {
+	switch e.Kind {
+	case EXPR_NUMBER:
+		f, _ := strconv.ParseFloat(e.Value, 64)
+		return f
+	case EXPR_STRING:
+		return e.Value
+	case EXPR_BOOL:
+		return e.Value == "true"
+	case EXPR_VAR:
+		return state[e.Value]
+	}
+	args := make([]interface{}, len(e.Args))
+	for i := range e.Args {
+		args[i] = e.Args[i].eval(state)
+	}
+	return applyOp(e.Value, args)
+}
+
+func applyOp(op string, args []interface{}) interface{} {
+	switch op {
+	case "+":
+		for _, a := range args {
+			if _, ok := a.(string); ok {
+				result := ""
+				for _, b := range args {
+					result += showValue(b)
+				}
+				return result
+			}
+		}
+		result := 0.0
+		for _, a := range args {
+			result += toNumber(a)
+		}
+		return result
+	case "-":
+		if len(args) == 1 {
+			return -toNumber(args[0])
+		}
+		result := toNumber(args[0])
+		for _, a := range args[1:] {
+			result -= toNumber(a)
+		}
+		return result
+	case "*":
+		result := 1.0
+		for _, a := range args {
+			result *= toNumber(a)
+		}
+		return result
+	case "/":
+		result := toNumber(args[0])
+		for _, a := range args[1:] {
+			result /= toNumber(a)
+		}
+		return result
+	case "=":
+		return equalValues(args[0], args[1])
+	case "!=":
+		return !equalValues(args[0], args[1])
+	case "<", ">", "<=", ">=":
+		c := compareValues(args[0], args[1])
+		switch op {
+		case "<":
+			return c < 0
+		case ">":
+			return c > 0
+		case "<=":
+			return c <= 0
+		}
+		return c >= 0
+	case "and":
+		for _, a := range args {
+			if !truthy(a) {
+				return a
+			}
+		}
+		return args[len(args)-1]
+	case "or":
+		for _, a := range args {
+			if truthy(a) {
+				return a
+			}
+		}
+		return args[len(args)-1]
+	case "not":
+		return !truthy(args[0])
+	}
+	return nil
+}
+
+// equalValues is strict: values of different types are never equal.
+func equalValues(a interface{}, b interface{}) bool {
+	switch x := a.(type) {
+	case nil:
+		return b == nil
+	case float64:
+		y, ok := b.(float64)
+		return ok && x == y
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	case bool:
+		y, ok := b.(bool)
+		return ok && x == y
+	}
+	return false
+}
+
+// compareValues compares strings as strings and everything else as numbers.
+func compareValues(a interface{}, b interface{}) int {
+	sa, okA := a.(string)
+	sb, okB := b.(string)
+	if okA && okB {
+		return strings.Compare(sa, sb)
+	}
+	na, nb := toNumber(a), toNumber(b)
+	if na < nb {
+		return -1
+	} else if na > nb {
+		return 1
+	}
+	return 0
+}
+
+func toNumber(v interface{}) float64 {
+	switch x := v.(type) {
+	case float64:
+		return x
+	case bool:
+		if x {
+			return 1
+		}
+		return 0
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		if err != nil {
+			return 0
+		}
+		return f
+	}
+	return 0
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0 && !math.IsNaN(x)
+	case string:
+		return x != ""
+	}
+	return true
+}
+
+// showNumber writes numbers the way String() does in JavaScript.
+func showNumber(x float64) string {
+	switch {
+	case math.IsNaN(x):
+		return "NaN"
+	case math.IsInf(x, 1):
+		return "Infinity"
+	case math.IsInf(x, -1):
+		return "-Infinity"
+	case x == 0:
+		return "0"
+	}
+	if a := math.Abs(x); a >= 1e21 || a < 1e-6 {
+		s := strconv.FormatFloat(x, 'e', -1, 64)
+		mant, exp := s[:strings.IndexByte(s, 'e')], s[strings.IndexByte(s, 'e')+1:]
+		return mant + "e" + exp[:1] + strings.TrimLeft(exp[1:], "0")
+	}
+	return strconv.FormatFloat(x, 'f', -1, 64)
+}
+
+func showValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return showNumber(x)
+	case bool:
+		return strconv.FormatBool(x)
+	case string:
+		return x
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// showExpr evaluates the expression of (+show expr) in state, and shows
+// its value.
+func showExpr(t *testing.T, expr string, state State) string {
+	psg, err := NewParser(strings.NewReader("(+show " + expr + ")")).Parse()
+	if err != nil {
+		t.Fatalf("%s: %v", expr, err)
+	}
+	return showValue(psg.Blocks[0].Content[0].Expr.eval(state))
+}
+
+// The expected values are what the evaluator of core-js gives, which
+// this evaluator must agree with.
+func TestEval(t *testing.T) {
+	state := State{"gold": 5.0, "name": "Ann", "flag": true, "none": nil}
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"42", "42"},
+		{"-1.5", "-1.5"},
+		{"gold", "5"},
+		{"missing", ""},
+		{"constructor", ""},
+		{"toString", ""},
+		{"__proto__", ""},
+		{"(+ gold 10)", "15"},
+		{"(+ \"gold: \" gold)", "gold: 5"},
+		{"(+ name missing flag)", "Anntrue"},
+		{"(+ \" 2 \" 3)", " 2 3"},
+		{"(+ flag flag)", "2"},
+		{"(- gold)", "-5"},
+		{"(- 0)", "0"},
+		{"(- 10 gold 1)", "4"},
+		{"(* gold \"2\")", "10"},
+		{"(* gold \"x\")", "0"},
+		{"(/ 1 3)", "0.3333333333333333"},
+		{"(/ 1 0)", "Infinity"},
+		{"(/ -1 0)", "-Infinity"},
+		{"(/ 0 0)", "NaN"},
+		{"(* 1000000 1000000 1000000 1000)", "1e+21"},
+		{"(* 1000000 1000000 1000000 100)", "100000000000000000000"},
+		{"(/ 1 10000000)", "1e-7"},
+		{"(/ 15 10000000)", "0.0000015"},
+		{"(/ 1 3000000)", "3.3333333333333335e-7"},
+		{"(= gold 5)", "true"},
+		{"(= gold \"5\")", "false"},
+		{"(= none missing)", "true"},
+		{"(!= name \"Ann\")", "false"},
+		{"(< \"10\" \"9\")", "true"},
+		{"(< \"10\" 9)", "false"},
+		{"(>= gold 5)", "true"},
+		{"(and gold name)", "Ann"},
+		{"(and 0 name)", "0"},
+		{"(or missing \"\" name)", "Ann"},
+		{"(or missing 0)", "0"},
+		{"(not (/ 0 0))", "true"},
+		{"(not \"\")", "true"},
+	}
+	for _, test := range tests {
+		if got := showExpr(t, test.expr, state); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.expr, got, test.want)
+		}
+	}
+}
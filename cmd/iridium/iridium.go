@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 )
@@ -10,6 +11,8 @@ const SRC_HTML = "game.html"
 const SRC_NOTES = "notes.txt"
 const SRC_PASSAGES = "passages"
 const SRC_ASSETS = "assets"
+const SRC_SAVES = "saves"
+const SRC_WALKTHROUGHS = "walkthroughs"
 
 const GAME_DIST = "dist"
 const GAME_HTML = "game.html"
@@ -23,8 +26,16 @@ func main() {
 		fmt.Println("Available commands:")
 		fmt.Println(" init <folder>")
 		fmt.Println(" run [<folder>]")
-		fmt.Println(" build [<folder>]")
-		fmt.Println(" dev [<folder>]")
+		fmt.Println(" build [--single-file] [--prune] [<folder>]")
+		fmt.Println(" package [--manifest] [--single-file] [--prune] [--out <file>] [<folder>]")
+		fmt.Println(" dev [--host <host>] [--port <port>] [--token <token>] [--open|--no-open] [<folder>]")
+		fmt.Println(" check [<folder>]")
+		fmt.Println(" test [<folder>]")
+		fmt.Println(" explore [--walks <n>] [--seed <s>] [--steps <n>] [<folder>]")
+		fmt.Println(" graph [--format dot|mermaid|json] [<folder>]")
+		fmt.Println(" import twee|twine-html <file> [<folder>]")
+		fmt.Println(" export twee [--out <file>] [<folder>]")
+		fmt.Println(" stats [--format table|json] [--limit <n>] [<folder>]")
 		return
 	}
 
@@ -36,39 +47,88 @@ func main() {
 		initialize(args[1])
 		
 	case "build":
+		buildCommand(args[1:])
+
+	case "package":
+		packageCommand(args[1:])
+
+	case "dev":
+		devCommand(args[1:])
+
+	case "run":
 		if len(args) > 2 {
-			stop("USAGE: iridium build [<folder>]")
+			stop("USAGE: iridium run [<folder>]")
 		}
 		if len(args) == 1 {
-			build(".")
+			run(".")
 		} else {
-			build(args[1])
+			run(args[1])
 		}
 
-	case "dev":
+	case "check":
 		if len(args) > 2 {
-			stop("USAGE: iridium dev [<folder>]")
+			stop("USAGE: iridium check [<folder>]")
 		}
 		if len(args) == 1 {
-			devCommand(".")
+			check(".")
 		} else {
-			devCommand(args[1])
+			check(args[1])
 		}
 
-	case "run":
+	case "test":
 		if len(args) > 2 {
-			stop("USAGE: iridium run [<folder>]")
+			stop("USAGE: iridium test [<folder>]")
 		}
 		if len(args) == 1 {
-			run(".")
+			test(".")
 		} else {
-			run(args[1])
+			test(args[1])
 		}
+
+	case "explore":
+		explore(args[1:])
+
+	case "graph":
+		graph(args[1:])
+
+	case "import":
+		importCommand(args[1:])
+
+	case "export":
+		exportCommand(args[1:])
+
+	case "stats":
+		statsCommand(args[1:])
+
 	default:
 		stop(fmt.Sprintf("Unknown command: %s", args[0]))
 	}
 }
 
+// Commands with flags parse their own arguments. Flags come before the
+// folder, which defaults to the current one.
+
+func newFlags(command string, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: iridium %s %s\n", command, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func parseFolder(flags *flag.FlagSet, args []string) string {
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if flags.NArg() == 1 {
+		return flags.Arg(0)
+	}
+	return "."
+}
+
 // for most errors, don't try to recover, just stop
 
 func stop(message string) {
@@ -7,12 +7,15 @@ import (
 	"io"
 	"bytes"
 	"fmt"
+	"strings"
 )
 
 
 /*
    A passage is an array of blocks and a set of options
-   Each block is an array of strings
+   Each block is an array of strings, an image, a (# set ...) of a state
+   variable, a (# if ...) conditional holding blocks of its own, or a
+   sound, music or stop-music cue
 */
 
 type BlockKind int
@@ -21,6 +24,11 @@ type TextKind int
 const (
 	TEXT BlockKind = iota
 	IMAGE
+	SET
+	COND
+	SOUND
+	MUSIC
+	STOP_MUSIC
 )
 
 const (
@@ -28,19 +36,52 @@ const (
 	TEXT_QUOTE
 	TEXT_EMPH
 	TEXT_STRONG
+	TEXT_SHOW
 )
 
+// Pos is a position in a passage; lines and columns count from 1.
+type Pos struct {
+	Line int
+	Col int
+}
+
+// Span is the stretch of a passage that a node was parsed from.
+type Span struct {
+	Start Pos
+	End Pos
+}
+
+// Glued is set when no whitespace separates the item from the previous one.
 type Text struct {
 	Kind TextKind
 	Word string
 	Content []Text
+	Expr *Expr
+	Glued bool
+	Span Span
 }
 
+// SET blocks assign Expr to Var; COND blocks choose Then or Else on Expr.
+// IMAGE blocks show Image, described by Alt and captioned by Caption;
+// Width is a CSS length, Class a CSS class and Style inline CSS.
+// SOUND blocks play Sound once; MUSIC blocks play Sound in the background
+// across passages, over and over if Loop, until a STOP_MUSIC block.
 type Block struct {
 	Kind BlockKind
 	Content []Text
 	Image string
+	Alt string
+	Caption string
+	Width string
+	Class string
 	Style string
+	Sound string
+	Loop bool
+	Var string
+	Expr *Expr
+	Then []Block
+	Else []Block
+	Span Span
 }
 
 type Passage struct {
@@ -49,9 +90,16 @@ type Passage struct {
 	Title []Text
 }
 
+// An option is listed only when Cond holds (if any) and, for a Once option,
+// it has not been taken yet. A Sticky option stays listed, but cannot be
+// taken, when either of those fails.
 type Option struct {
 	Target string
 	Content []Text
+	Cond *Expr
+	Once bool
+	Sticky bool
+	Span Span
 }
 
 
@@ -94,26 +142,37 @@ var eof = rune(0)
 type Scanner struct {
 	r *bufio.Reader
 	parenCount int
+	pos Pos    // position of the next rune
+	prev Pos   // position before the last read, for unread
+	start Pos  // position where the last token started
 }
 
 // NewScanner returns a new instance of Scanner.
 func NewScanner(r io.Reader) *Scanner {
-	return &Scanner{r: bufio.NewReader(r), parenCount: 0}
+	return &Scanner{r: bufio.NewReader(r), parenCount: 0, pos: Pos{1, 1}}
 }
 
 // read reads the next rune from the bufferred reader.
 // Returns the rune(0) if an error occurs (or io.EOF is returned).
 func (s *Scanner) read() rune {
+	s.prev = s.pos
 	ch, _, err := s.r.ReadRune()
 	if err != nil {
 		return eof
 	}
+	if ch == '\n' {
+		s.pos.Line += 1
+		s.pos.Col = 1
+	} else {
+		s.pos.Col += 1
+	}
 	return ch
 }
 
 // unread places the previously read rune back on the reader.
 func (s *Scanner) unread() {
 	_ = s.r.UnreadRune()
+	s.pos = s.prev
 }
 
 func (s *Scanner) incr() {
@@ -132,6 +191,7 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 	if (s.parenCount > 0) {
 		return s.ScanDirective()
 	}
+	s.start = s.pos
 	// Read the next rune.
 	ch := s.read()
 
@@ -153,6 +213,7 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 
 // ScanDirective returns the next token and literal value in the context of a directive
 func (s *Scanner) ScanDirective() (tok Token, lit string) {
+	s.start = s.pos
 	// Read the next rune.
 	ch := s.read()
 
@@ -183,12 +244,16 @@ func (s *Scanner) scanParen() (tok Token, lit string) {
 		// Treat as a parenthesis open so we can catch the corresponding close.
 		s.incr()
 		return ANNOTATION, ""
+	} else if ch == '+' {
+		s.incr()
+		return INLINE, ""
 	} else if ch == ';' {
 		return s.scanSkipComment()
 	}
-	// Forget the first ( and treat as current word.
+	// A plain ( starts the current word.
 	s.unread()
-	return s.scanWord()
+	_, lit = s.scanWord()
+	return WORD, "(" + lit
 }
 
 func (s *Scanner) scanSkipComment() (tok Token, lit string) {
@@ -251,8 +316,12 @@ func (s *Scanner) scanWord() (tok Token, lit string) {
 	var buf bytes.Buffer
 	
 	// Read every subsequent character into the buffer until a
-	// special character
+	// special character, or an annotation, inline form or comment
+	// glued to the word
 	for {
+		if next, _ := s.r.Peek(2); len(next) == 2 && next[0] == '(' && (next[1] == '+' || next[1] == '#' || next[1] == ';') {
+			break
+		}
 		ch := s.read()
 		if ch == eof {
 			break
@@ -314,8 +383,41 @@ type Parser struct {
 	buf struct {
 		tok Token  // last read token
 		lit string // last read literal
+		pos Pos    // start of last read token
+		end Pos    // end of last read token
 		n   int    // buffer size (max=1)
 	}
+	glued bool  // no whitespace before the last token
+	pos Pos     // start of the last token
+	end Pos     // end of the last token
+	closer Pos  // start of the last else or end closing an if
+	errors ParseErrors
+	warnings ParseErrors
+}
+
+// ParseError is a problem found at a position in a passage file.
+type ParseError struct {
+	File string
+	Pos Pos
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%d:%d: %s", e.Pos.Line, e.Pos.Col, e.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Pos.Line, e.Pos.Col, e.Message)
+}
+
+// ParseErrors is every problem found in a passage, in order.
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
 }
 
 // NewParser returns a new instance of Parser.
@@ -329,14 +431,17 @@ func (p *Parser) scan() (tok Token, lit string) {
 	// If we have a token on the buffer, then return it.
 	if p.buf.n != 0 {
 		p.buf.n = 0
+		p.pos, p.end = p.buf.pos, p.buf.end
 		return p.buf.tok, p.buf.lit
 	}
 
 	// Otherwise read the next token from the scanner.
 	tok, lit = p.s.Scan()
+	p.pos, p.end = p.s.start, p.s.pos
 
 	// Save it to the buffer in case we unscan later.
 	p.buf.tok, p.buf.lit = tok, lit
+	p.buf.pos, p.buf.end = p.pos, p.end
 
 	///fmt.Println("In scan()", tok, lit)
 	return
@@ -348,14 +453,17 @@ func (p *Parser) scanDirective() (tok Token, lit string) {
 	// If we have a token on the buffer, then return it.
 	if p.buf.n != 0 {
 		p.buf.n = 0
+		p.pos, p.end = p.buf.pos, p.buf.end
 		return p.buf.tok, p.buf.lit
 	}
 
 	// Otherwise read the next token from the scanner.
 	tok, lit = p.s.ScanDirective()
+	p.pos, p.end = p.s.start, p.s.pos
 
 	// Save it to the buffer in case we unscan later.
 	p.buf.tok, p.buf.lit = tok, lit
+	p.buf.pos, p.buf.end = p.pos, p.end
 
 	///fmt.Println("In scanDirective()", tok, lit)
 	return
@@ -367,7 +475,10 @@ func (p *Parser) unscan() { p.buf.n = 1 }
 // scanIgnoreWhitespace scans the next non-whitespace token.
 func (p *Parser) scanIgnoreWhitespace() (tok Token, lit string) {
 	tok, lit = p.scan()
-	if tok == WS {
+	p.glued = true
+	// A comment between spaces leaves two whitespace tokens.
+	for tok == WS {
+		p.glued = false
 		tok, lit = p.scan()
 	}
 	return
@@ -382,166 +493,462 @@ func (p *Parser) scanDirectiveIgnoreWhitespace() (tok Token, lit string) {
 	return
 }
 
+// textReader accumulates text items, nesting the ones between quotes.
+type textReader struct {
+	text []Text
+	saved []Text
+	inQuote bool
+	glued bool
+	start Pos
+}
+
+func (t *textReader) add(item Text) {
+	t.text = append(t.text, item)
+}
+
+func (t *textReader) quote(glued bool, span Span) {
+	if t.inQuote {
+		t.inQuote = false
+		t.saved = append(t.saved, Text{Kind: TEXT_QUOTE, Content: t.text, Glued: t.glued, Span: Span{t.start, span.End}})
+		t.text = t.saved
+	} else {
+		t.inQuote = true
+		t.glued = glued
+		t.start = span.Start
+		t.saved = t.text
+		t.text = make([]Text, 0, 10)
+	}
+}
+
+// close ends any open quote and returns the text read so far.
+func (t *textReader) close() []Text {
+	if t.inQuote {
+		end := t.start
+		if len(t.text) > 0 {
+			end = t.text[len(t.text) - 1].Span.End
+		}
+		t.quote(false, Span{end, end})
+	}
+	text := t.text
+	if text == nil {
+		text = make([]Text, 0)
+	}
+	t.text = make([]Text, 0, 10)
+	return text
+}
+
+func textSpan(text []Text) Span {
+	return Span{text[0].Span.Start, text[len(text) - 1].Span.End}
+}
+
+// errorf records a problem at pos. Parsing goes on after most problems;
+// the ones it cannot get past are also returned, to unwind the parser.
+func (p *Parser) errorf(pos Pos, format string, args ...interface{}) error {
+	err := &ParseError{Pos: pos, Message: fmt.Sprintf(format, args...)}
+	p.errors = append(p.errors, err)
+	return err
+}
+
+// warnf records something the parser skips over, like an unknown
+// annotation. Warnings do not make Parse fail.
+func (p *Parser) warnf(pos Pos, format string, args ...interface{}) {
+	p.warnings = append(p.warnings, &ParseError{Pos: pos, Message: fmt.Sprintf(format, args...)})
+}
+
+// Warnings returns the warnings of the last Parse.
+func (p *Parser) Warnings() ParseErrors {
+	return p.warnings
+}
+
+// Parse reads a passage. On error, the passage holds whatever could be
+// parsed, and the error is a ParseErrors listing every problem found.
 func (p *Parser) Parse() (*Passage, error) {
-	// There is probably a nicer way to write this, possibly recursively.
 	passage := &Passage{make([]Block, 0, 10), make([]Option, 0, 10), make([]Text, 0, 10)}
-	inQuote := false
-	var savedText []Text
-	blockText := make([]Text, 0, 10)
+	passage.Blocks, _, _ = p.parseBlocks(passage, 0)
+	if len(p.errors) > 0 {
+		return passage, p.errors
+	}
+	return passage, nil
+}
+
+// parseBlocks reads blocks until EOF, or until the else or end annotation
+// closing the conditional at the given depth, which it returns.
+func (p *Parser) parseBlocks(passage *Passage, depth int) ([]Block, string, error) {
+	blocks := make([]Block, 0, 10)
+	text := &textReader{}
+	flush := func() {
+		if t := text.close(); len(t) > 0 {
+			blocks = append(blocks, Block{Kind: TEXT, Content: t, Span: textSpan(t)})
+		}
+	}
 	for {
 		tok, lit := p.scanIgnoreWhitespace()
-
-		if tok == ILLEGAL {
-			return nil, fmt.Errorf("Illegal lexeme")
+		switch tok {
+		case ILLEGAL:
+			p.errorf(p.pos, "Illegal lexeme")
+		case WORD:
+			text.add(Text{Kind: TEXT_WORD, Word: lit, Glued: p.glued, Span: Span{p.pos, p.end}})
+		case QUOTE:
+			text.quote(p.glued, Span{p.pos, p.end})
+		case INLINE:
+			item, err := p.parseInline(p.glued)
+			if err != nil {
+				flush()
+				return blocks, "", err
+			}
+			if item != nil {
+				text.add(*item)
+			}
+		case NL:
+			flush()
+		case EOF:
+			flush()
+			return blocks, "", nil
+		case ANNOTATION:
+			flush()
+			start := p.pos
+			sexp, err := p.parseSExpressions()
+			if err != nil {
+				return blocks, "", err
+			}
+			span := Span{start, p.end}
+			if !sexp.index(0).isSymbol() {
+				p.warnf(start, "Unknown annotation %s", sexp.str())
+				continue
+			}
+			switch sexp.index(0).value {
+			case "option":
+				option, err := p.parseOption(sexp, start)
+				if err != nil {
+					return blocks, "", err
+				}
+				if depth > 0 {
+					p.errorf(start, "Option inside if")
+				} else if option != nil {
+					passage.Options = append(passage.Options, *option)
+				}
+			case "image":
+				if !sexp.index(1).isString() {
+					p.errorf(start, "No image name supplied with image")
+					continue
+				}
+				args := p.parseKeywords(sexp, 2, start, "image", imageKeywords)
+				width := args["width"]
+				if isNumber(width) {
+					width += "px"
+				}
+				blocks = append(blocks, Block{
+					Kind: IMAGE,
+					Image: sexp.index(1).value,
+					Alt: args["alt"],
+					Caption: args["caption"],
+					Width: width,
+					Class: args["class"],
+					Style: args["style"],
+					Span: span,
+				})
+			case "sound", "music":
+				name := sexp.index(0).value
+				if !sexp.index(1).isString() {
+					p.errorf(start, "No sound file supplied with %s", name)
+					continue
+				}
+				kind, keywords := SOUND, soundKeywords
+				if name == "music" {
+					kind, keywords = MUSIC, musicKeywords
+				}
+				args := p.parseKeywords(sexp, 2, start, name, keywords)
+				blocks = append(blocks, Block{Kind: kind, Sound: sexp.index(1).value, Loop: args["loop"] != "", Span: span})
+			case "stop-music":
+				if sexp.index(1) != nil {
+					p.errorf(start, "Extra junk after stop-music")
+				}
+				blocks = append(blocks, Block{Kind: STOP_MUSIC, Span: span})
+			case "title":
+				text, err := p.parseText("title")
+				if err != nil {
+					return blocks, "", err
+				}
+				passage.Title = text
+			case "set":
+				if !sexp.index(1).isSymbol() || !isVariable(sexp.index(1).value) {
+					p.errorf(start, "No variable supplied with set")
+					continue
+				}
+				if sexp.index(3) != nil {
+					p.errorf(start, "Extra junk after set value")
+				}
+				expr, err := newExpr(sexp.index(2))
+				if err != nil {
+					p.errorf(start, "%s", err)
+					continue
+				}
+				blocks = append(blocks, Block{Kind: SET, Var: sexp.index(1).value, Expr: expr, Span: span})
+			case "if":
+				if sexp.index(2) != nil {
+					p.errorf(start, "Extra junk after if condition")
+				}
+				expr, err := newExpr(sexp.index(1))
+				if err != nil {
+					p.errorf(start, "%s", err)
+				}
+				cond := Block{Kind: COND, Expr: expr}
+				var closer string
+				cond.Then, closer, err = p.parseBlocks(passage, depth + 1)
+				if err != nil {
+					return blocks, "", err
+				}
+				for closer == "else" {
+					if cond.Else != nil {
+						p.errorf(p.closer, "Extra else in if")
+					}
+					cond.Else, closer, err = p.parseBlocks(passage, depth + 1)
+					if err != nil {
+						return blocks, "", err
+					}
+				}
+				if closer == "" {
+					return blocks, "", p.errorf(start, "Missing end after if")
+				}
+				cond.Span = Span{start, p.end}
+				if expr != nil {
+					blocks = append(blocks, cond)
+				}
+			case "else", "end":
+				name := sexp.index(0).value
+				if sexp.index(1) != nil {
+					p.errorf(start, "Extra junk after %s", name)
+				}
+				if depth == 0 {
+					p.errorf(start, "Unexpected %s outside of if", name)
+					continue
+				}
+				p.closer = start
+				return blocks, name, nil
+			default:
+				p.warnf(start, "Unknown annotation %s", sexp.index(0).value)
+			}
 		}
-		if tok == WORD {
-			blockText = append(blockText, Text{TEXT_WORD, lit, nil})
+	}
+}
+
+// Keyword arguments of annotations, and whether they take a value.
+var imageKeywords = map[string]bool{"alt": true, "caption": true, "width": true, "class": true, "style": true}
+var soundKeywords = map[string]bool{}
+var musicKeywords = map[string]bool{"loop": false}
+
+// parseKeywords reads the keyword arguments of an annotation from index
+// from on, as in (# image "map.png" :alt "Old map" :width 50%). Flags,
+// which take no value, are set to "true".
+func (p *Parser) parseKeywords(sexp *SExp, from int, start Pos, what string, keywords map[string]bool) map[string]string {
+	args := make(map[string]string)
+	for i := from; sexp.index(i) != nil; i++ {
+		key := sexp.index(i)
+		if !key.isSymbol() || !strings.HasPrefix(key.value, ":") {
+			p.errorf(start, "Expected a :keyword in %s, got %s", what, key.str())
+			continue
 		}
-		if tok == NL {
-			if len(blockText) > 0 { 
-				passage.Blocks = append(passage.Blocks, Block{TEXT, blockText, "", ""})
-				blockText = make([]Text, 0, 10)
+		name := key.value[1:]
+		valued, ok := keywords[name]
+		if !ok {
+			p.errorf(start, "Unknown %s argument %s", what, key.value)
+			if next := sexp.index(i + 1); next != nil && !(next.isSymbol() && strings.HasPrefix(next.value, ":")) {
+				i += 1
 			}
+			continue
 		}
-		if tok == QUOTE {
-			if inQuote {
-				inQuote = false
-				savedText = append(savedText, Text{TEXT_QUOTE, "", blockText})
-				blockText = savedText
-			} else {
-				inQuote = true
-				savedText = blockText
-				blockText = make([]Text, 0, 10)
-			}
+		if !valued {
+			args[name] = "true"
+			continue
+		}
+		value := sexp.index(i + 1)
+		if !value.isString() && !value.isSymbol() || value.isSymbol() && strings.HasPrefix(value.value, ":") {
+			p.errorf(start, "Missing value for %s in %s", key.value, what)
+			continue
 		}
-		if tok == EOF {
-			if inQuote {
-				inQuote = false
-				savedText = append(savedText, Text{TEXT_QUOTE, "", blockText})
-				blockText = savedText
-			}				
-			if len(blockText) > 0 { 
-				passage.Blocks = append(passage.Blocks, Block{TEXT, blockText, "", ""})
+		args[name] = value.value
+		i += 1
+	}
+	return args
+}
+
+// parseOption reads (# option "target" [if <expr>] [once] [sticky]) and
+// the text up to its (# end). The option is nil if it cannot be used.
+func (p *Parser) parseOption(sexp *SExp, start Pos) (*Option, error) {
+	option := &Option{}
+	if sexp.index(1).isString() {
+		option.Target = sexp.index(1).value
+	} else {
+		p.errorf(start, "No name supplied with option")
+		option = nil
+	}
+	for i := 2; sexp.index(i) != nil; i++ {
+		mod := sexp.index(i)
+		if !mod.isSymbol() {
+			p.errorf(start, "Extra junk after option name")
+			continue
+		}
+		switch mod.value {
+		case "if":
+			expr, err := newExpr(sexp.index(i + 1))
+			if err != nil {
+				p.errorf(start, "%s", err)
+			} else if option != nil && option.Cond != nil {
+				p.errorf(start, "Duplicate if in option")
+			} else if option != nil {
+				option.Cond = expr
+			}
+			i++
+		case "once":
+			if option != nil {
+				option.Once = true
 			}
-			return passage, nil
+		case "sticky":
+			if option != nil {
+				option.Sticky = true
+			}
+		default:
+			p.errorf(start, "Unknown option modifier %s", mod.value)
 		}
-		if tok == ANNOTATION {
-			if inQuote {
-				inQuote = false
-				savedText = append(savedText, Text{TEXT_QUOTE, "", blockText})
-				blockText = savedText
-			}				
-			if len(blockText) > 0 { 
-				passage.Blocks = append(passage.Blocks, Block{TEXT, blockText, "", ""})
-				blockText = make([]Text, 0, 10)
+	}
+	text, err := p.parseText("option")
+	if err != nil {
+		return nil, err
+	}
+	if option != nil {
+		option.Content = text
+		option.Span = Span{start, p.end}
+	}
+	return option, nil
+}
+
+// parseText reads the text of an option or title up to its (# end).
+func (p *Parser) parseText(what string) ([]Text, error) {
+	text := &textReader{}
+	for {
+		tok, lit := p.scanIgnoreWhitespace()
+		if tok == WORD {
+			text.add(Text{Kind: TEXT_WORD, Word: lit, Glued: p.glued, Span: Span{p.pos, p.end}})
+		} else if tok == QUOTE {
+			text.quote(p.glued, Span{p.pos, p.end})
+		} else if tok == INLINE {
+			item, err := p.parseInline(p.glued)
+			if err != nil {
+				return nil, err
+			}
+			if item != nil {
+				text.add(*item)
 			}
+		} else if tok == ANNOTATION {
+			start := p.pos
 			sexp, err := p.parseSExpressions()
 			if err != nil {
 				return nil, err
 			}
-			if sexp.index(0).isSymbol() && sexp.index(0).value == "option" {
-				if !sexp.index(1).isString() {
-					return nil, fmt.Errorf("No name supplied with option")
-				}
-				target := sexp.index(1).value
-				if sexp.index(2) != nil  {
-					return nil, fmt.Errorf("Extra junk after option name")
-				}
-				inQuote := false
-				var savedText []Text
-				text := make([]Text, 0, 10)
-				for {
-					tok, lit = p.scanIgnoreWhitespace()
-					if tok == WORD {
-						text = append(text, Text{TEXT_WORD, lit, nil})
-					} else if tok == QUOTE {
-						if inQuote {
-							inQuote = false
-							savedText = append(savedText, Text{TEXT_QUOTE, "", text})
-							text = savedText
-						} else {
-							inQuote = true
-							savedText = text
-							text = make([]Text, 0, 10)
-						}
-					} else if tok == ANNOTATION {
-						if inQuote {
-							inQuote = false
-							savedText = append(savedText, Text{TEXT_QUOTE, "", text})
-							text = savedText
-						}
-						sexp, err := p.parseSExpressions()
-						if err != nil {
-							return nil, err
-						}
-						if sexp.index(0).isSymbol() && sexp.index(0).value == "end" {
-							if sexp.index(1) != nil {
-								return nil, fmt.Errorf("Extra junk after end")
-							}
-							break
-						} else {
-							return nil, fmt.Errorf("Illegal token in option text")
-						}
-					} else {
-						return nil, fmt.Errorf("Illegal token in option text")
-					}
-				}
-				passage.Options = append(passage.Options, Option{target, text})
-			} else if sexp.index(0).isSymbol() && sexp.index(0).value == "image" {
-				if !sexp.index(1).isString() {
-					return nil, fmt.Errorf("No image name supplied with image")
+			if sexp.index(0).isSymbol() && sexp.index(0).value == "end" {
+				if sexp.index(1) != nil {
+					p.errorf(start, "Extra junk after end")
 				}
-				target := sexp.index(1).value
-				if sexp.index(2) != nil  {
-					return nil, fmt.Errorf("Extra junk after image name")
-				}
-				if len(blockText) > 0 { 
-					passage.Blocks = append(passage.Blocks, Block{TEXT, blockText, "", ""})
-					blockText = make([]Text, 0, 10)
+				return text.close(), nil
+			}
+			p.errorf(start, "Illegal annotation in %s text", what)
+		} else if tok == EOF {
+			return nil, p.errorf(p.pos, "Missing end after %s text", what)
+		} else {
+			p.errorf(p.pos, "Illegal token in %s text", what)
+		}
+	}
+}
+
+// parseInline reads an inline form after its (+: either (+show <expr>),
+// or (+em ...) and (+strong ...) around text. The item is nil if the
+// form cannot be used.
+func (p *Parser) parseInline(glued bool) (*Text, error) {
+	start := p.pos
+	tok, lit := p.scanIgnoreWhitespace()
+	if tok != WORD {
+		p.errorf(start, "No name supplied with inline form")
+		p.unscan()
+		_, err := p.parseSExpressions()
+		return nil, err
+	}
+	return p.parseInlineForm(strings.ToLower(lit), glued, start)
+}
+
+func (p *Parser) parseInlineForm(name string, glued bool, start Pos) (*Text, error) {
+	switch name {
+	case "show":
+		sexp, err := p.parseSExpressions()
+		if err != nil {
+			return nil, err
+		}
+		if sexp.index(1) != nil {
+			p.errorf(start, "Extra junk after show expression")
+		}
+		expr, err := newExpr(sexp.index(0))
+		if err != nil {
+			p.errorf(start, "%s", err)
+			return nil, nil
+		}
+		return &Text{Kind: TEXT_SHOW, Expr: expr, Glued: glued, Span: Span{start, p.end}}, nil
+	case "em", "strong":
+		content, err := p.parseInlineText(name)
+		if err != nil {
+			return nil, err
+		}
+		kind := TEXT_EMPH
+		if name == "strong" {
+			kind = TEXT_STRONG
+		}
+		return &Text{Kind: kind, Content: content, Glued: glued, Span: Span{start, p.end}}, nil
+	}
+	p.errorf(start, "Unknown inline form %s", name)
+	_, err := p.parseSExpressions()
+	return nil, err
+}
+
+// parseInlineText reads text up to the ) closing an inline form. The
+// scanner is in directive mode here, so quotes come back as strings and
+// nested parentheses as open and close tokens.
+func (p *Parser) parseInlineText(what string) ([]Text, error) {
+	text := &textReader{}
+	depth := 0
+	for {
+		tok, lit := p.scanIgnoreWhitespace()
+		switch tok {
+		case WORD:
+			text.add(Text{Kind: TEXT_WORD, Word: lit, Glued: p.glued, Span: Span{p.pos, p.end}})
+		case STRING:
+			quoted := make([]Text, 0, 10)
+			for _, word := range strings.Fields(lit) {
+				quoted = append(quoted, Text{Kind: TEXT_WORD, Word: word, Span: Span{p.pos, p.end}})
+			}
+			text.add(Text{Kind: TEXT_QUOTE, Content: quoted, Glued: p.glued, Span: Span{p.pos, p.end}})
+		case OPEN:
+			glued, start := p.glued, p.pos
+			tok, lit = p.scan()
+			if tok == WORD && strings.HasPrefix(lit, "+") {
+				// A nested inline form.
+				item, err := p.parseInlineForm(strings.ToLower(lit[1:]), glued, start)
+				if err != nil {
+					return nil, err
 				}
-				passage.Blocks = append(passage.Blocks, Block{IMAGE, nil, target, ""})
-			} else if sexp.index(0).isSymbol() &&sexp.index(0).value == "title" {
-				inQuote := false
-				var savedText []Text
-				text := make([]Text, 0, 10)
-				for {
-					tok, lit = p.scanIgnoreWhitespace()
-					if tok == WORD {
-						text = append(text, Text{TEXT_WORD, lit, nil})
-					} else if tok == QUOTE {
-						if inQuote {
-							inQuote = false
-							savedText = append(savedText, Text{TEXT_QUOTE, "", text})
-							text = savedText
-						} else {
-							inQuote = true
-							savedText = text
-							text = make([]Text, 0, 10)
-						}
-					} else if tok == ANNOTATION {
-						if inQuote {
-							inQuote = false
-							savedText = append(savedText, Text{TEXT_QUOTE, "", text})
-							text = savedText
-						}
-						sexp, err := p.parseSExpressions()
-						if err != nil {
-							return nil, err
-						}
-						if sexp.index(0).isSymbol() && sexp.index(0).value == "end" {
-							if sexp.index(1) != nil {
-								return nil, fmt.Errorf("Extra junk after end")
-							}
-							break
-						} else {
-							return nil, fmt.Errorf("Illegal token in title text")
-						}
-					} else {
-						return nil, fmt.Errorf("Illegal token in title text")
-					}
+				if item != nil {
+					text.add(*item)
 				}
-				passage.Title = text
+				continue
+			}
+			p.unscan()
+			depth += 1
+			text.add(Text{Kind: TEXT_WORD, Word: "(", Glued: glued, Span: Span{start, Pos{start.Line, start.Col + 1}}})
+		case CLOSE:
+			if depth == 0 {
+				return text.close(), nil
 			}
+			depth -= 1
+			text.add(Text{Kind: TEXT_WORD, Word: ")", Glued: true, Span: Span{p.pos, p.end}})
+		default:
+			return nil, p.errorf(p.pos, "Missing ) after %s text", what)
 		}
 	}
 }
@@ -572,8 +979,10 @@ func (p *Parser) parseSExpressions() (*SExp, error) {
 			//fmt.Printf("result: %s\n", result)
 			//fmt.Printf("result: %s\n", result.str())
 			return result, nil
+		} else if tok == EOF {
+			return nil, p.errorf(p.pos, "Missing ) at end of passage")
 		} else {
-			return nil, fmt.Errorf("Illegal token in s-expression: %d %s", tok, lit)
+			return nil, p.errorf(p.pos, "Illegal token in s-expression: %d %s", tok, lit)
 		}
 		new_node := newCons(car, sNil)
 		if curr == nil {
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// shape writes text with its structure: glued items follow a +, and
+// markup wraps what it holds in brackets.
+func shape(items []Text) string {
+	parts := make([]string, len(items))
+	for i, item := range items {
+		glue := ""
+		if i > 0 && item.Glued {
+			glue = "+"
+		}
+		switch item.Kind {
+		case TEXT_WORD:
+			parts[i] = glue + item.Word
+		case TEXT_QUOTE:
+			parts[i] = glue + "q[" + shape(item.Content) + "]"
+		case TEXT_EMPH:
+			parts[i] = glue + "em[" + shape(item.Content) + "]"
+		case TEXT_STRONG:
+			parts[i] = glue + "strong[" + shape(item.Content) + "]"
+		case TEXT_SHOW:
+			parts[i] = glue + "show[" + item.Expr.String() + "]"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestParseText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Hello, world.", "Hello, world."},
+		{"Say \"hi there\" now.", "Say q[hi there] now."},
+		{"A (+em big) and (+strong bold) word.", "A em[big] and strong[bold] word."},
+		{"(+em (+strong both)) ways", "em[strong[both]] ways"},
+		{"You have (+show gold) coins.", "You have show[gold] coins."},
+		{"gold(+show gold) and (+show gold)coins", "gold +show[gold] and show[gold] +coins"},
+		{"very(+em much)!", "very +em[much] +!"},
+		{"\"(+show name)\"", "q[show[name]]"},
+		{"Hi (+show (+ \"a\" name)).", "Hi show[(+ \"a\" name)] +."},
+		{"f(x) stays a word", "f(x) stays a word"},
+		{"word(; a comment ;) after", "word after"},
+		{"before (; a comment ;)glued", "before glued"},
+		{"one (; a (nested) comment ;) two", "one two"},
+		{"no;) comment", "no;) comment"},
+		{"a ( # b and ( + c", "a ( # b and ( + c"},
+	}
+	for _, test := range tests {
+		psg, err := NewParser(strings.NewReader(test.text)).Parse()
+		if err != nil {
+			t.Errorf("%q: %v", test.text, err)
+			continue
+		}
+		if len(psg.Blocks) != 1 || psg.Blocks[0].Kind != TEXT {
+			t.Errorf("%q: got %d blocks, want one text", test.text, len(psg.Blocks))
+			continue
+		}
+		if got := shape(psg.Blocks[0].Content); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestParseBlocks(t *testing.T) {
+	text := `(# set gold 5)
+(# if (> gold 3))
+Rich.
+(# else)
+Poor.
+(# end)
+
+(# option "shop" if gold once) Buy (# end)
+(# option "shop" sticky) Look (# end)
+(# option "home") Home (# end)`
+	psg, err := NewParser(strings.NewReader(text)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(psg.Blocks) != 2 || psg.Blocks[0].Kind != SET || psg.Blocks[1].Kind != COND {
+		t.Fatalf("got blocks %v, want set and if", psg.Blocks)
+	}
+	if set := psg.Blocks[0]; set.Var != "gold" || set.Expr.String() != "5" {
+		t.Errorf("got set %s %s, want set gold 5", set.Var, set.Expr)
+	}
+	cond := psg.Blocks[1]
+	if cond.Expr.String() != "(> gold 3)" || shape(cond.Then[0].Content) != "Rich." || shape(cond.Else[0].Content) != "Poor." {
+		t.Errorf("got if %s then %v else %v", cond.Expr, cond.Then, cond.Else)
+	}
+	options := []struct {
+		target string
+		content string
+		cond string
+		once bool
+		sticky bool
+	}{
+		{"shop", "Buy", "gold", true, false},
+		{"shop", "Look", "", false, true},
+		{"home", "Home", "", false, false},
+	}
+	if len(psg.Options) != len(options) {
+		t.Fatalf("got %d options, want %d", len(psg.Options), len(options))
+	}
+	for i, want := range options {
+		option := psg.Options[i]
+		cond := ""
+		if option.Cond != nil {
+			cond = option.Cond.String()
+		}
+		if option.Target != want.target || shape(option.Content) != want.content || cond != want.cond || option.Once != want.once || option.Sticky != want.sticky {
+			t.Errorf("option %d: got %+v, want %+v", i, option, want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		// Positions of the errors, as line:col.
+		want []string
+	}{
+		{"(# option \"a\") text", []string{"1:20"}},
+		{"Fine.\n\n(# set)\n\n(# set)", []string{"3:1", "5:1"}},
+		{"(+show)", []string{"1:1"}},
+		{"(# if x)\nNo end.", []string{"1:1"}},
+	}
+	for _, test := range tests {
+		_, err := NewParser(strings.NewReader(test.text)).Parse()
+		errs, ok := err.(ParseErrors)
+		if !ok {
+			t.Errorf("%q: got %v, want parse errors", test.text, err)
+			continue
+		}
+		got := make([]string, len(errs))
+		for i, e := range errs {
+			got[i] = fmt.Sprintf("%d:%d", e.Pos.Line, e.Pos.Col)
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%q: got errors at %v, want %v\n%s", test.text, got, test.want, err)
+		}
+	}
+}
+
+func TestParseWarnings(t *testing.T) {
+	p := NewParser(strings.NewReader("Fine.\n\n(# bogus)"))
+	if _, err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	warnings := p.Warnings()
+	if len(warnings) != 1 || warnings[0].Pos != (Pos{3, 1}) {
+		t.Errorf("got warnings %v, want one at 3:1", warnings)
+	}
+}
@@ -1,11 +1,53 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
+	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
+// Passage names are file names in the passages folder, so they cannot
+// hold path separators or control characters. They cannot start with a
+// dot either, which rules out . and .. as well as hidden files.
+var passageNameUnsafe = regexp.MustCompile(`[/\\\x00-\x1f\x7f]`)
+
+// Passages made from the dev server also keep away from characters that
+// some file systems reject, so that the game can move between systems.
+var newPassageNameUnsafe = regexp.MustCompile(`[<>:"|?*]`)
+
+const maxPassageName = 200
+
+func checkPassageName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty passage name")
+	}
+	if strings.HasPrefix(name, ".") {
+		return fmt.Errorf("bad passage name %q, cannot start with a dot", name)
+	}
+	if !utf8.ValidString(name) || passageNameUnsafe.MatchString(name) {
+		return fmt.Errorf("bad passage name %q, cannot hold / \\ or control characters", name)
+	}
+	return nil
+}
+
+// checkNewPassageName checks the name of a passage about to be made.
+func checkNewPassageName(name string) error {
+	if err := checkPassageName(name); err != nil {
+		return err
+	}
+	if len(name) > maxPassageName {
+		return fmt.Errorf("passage name longer than %d bytes", maxPassageName)
+	}
+	if newPassageNameUnsafe.MatchString(name) {
+		return fmt.Errorf("bad passage name %q, cannot hold < > : \" | ? *", name)
+	}
+	return nil
+}
+
 func getPassageNames(srcdir string) ([]string, error) { 
 	files, err := ioutil.ReadDir(srcdir)
 	if err != nil {
@@ -13,7 +55,8 @@ func getPassageNames(srcdir string) ([]string, error) {
 	}
 	names := make([]string, 0, len(files))
 	for _, f := range files {
-		if strings.HasSuffix(f.Name(), ".txt") {
+		// Editors leave hidden files around, which are not passages.
+		if strings.HasSuffix(f.Name(), ".txt") && !strings.HasPrefix(f.Name(), ".") {
 			names = append(names, strings.TrimSuffix(f.Name(), ".txt"))
 		}
 	}
@@ -21,6 +64,9 @@ func getPassageNames(srcdir string) ([]string, error) {
 }
 
 func readPassage(srcdir string, passage string) (string, error) {
+	if err := checkPassageName(passage); err != nil {
+		return "", err
+	}
 	content, err := ioutil.ReadFile(path.Join(srcdir, passage + ".txt"))
 	if err != nil {
 		return "", err
@@ -28,6 +74,105 @@ func readPassage(srcdir string, passage string) (string, error) {
 	return string(content), nil
 }
 
+// parsePassage reads and parses a passage. Parse errors are reported
+// against the passage file.
+func parsePassage(srcdir string, passage string) (*Passage, error) {
+	psg, _, err := parsePassageWarnings(srcdir, passage)
+	return psg, err
+}
+
+// parsePassageWarnings is parsePassage, also returning the warnings of
+// the parser.
+func parsePassageWarnings(srcdir string, passage string) (*Passage, ParseErrors, error) {
+	text, err := readPassage(srcdir, passage)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := NewParser(strings.NewReader(text))
+	psg, err := p.Parse()
+	file := path.Join(srcdir, passage + ".txt")
+	if errs, ok := err.(ParseErrors); ok {
+		for _, e := range errs {
+			e.File = file
+		}
+	}
+	for _, e := range p.Warnings() {
+		e.File = file
+	}
+	return psg, p.Warnings(), err
+}
+
 func writePassage(srcdir string, passage string, text string) (error) {
-	return ioutil.WriteFile(path.Join(srcdir, passage + ".txt"), []byte(text), 0644)
+	if err := checkPassageName(passage); err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(srcdir, passage + ".txt"), []byte(text), 0644)
+}
+
+// optionsTo matches the options to a passage as they are written, up to
+// the passage name. Strings have no escapes, so the name is there as it is.
+func optionsTo(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(\(#\s*option\s+)"` + regexp.QuoteMeta(name) + `"`)
+}
+
+// linksTo lists the passages with options to a passage.
+func linksTo(srcdir string, passage string) ([]string, error) {
+	names, err := getPassageNames(srcdir)
+	if err != nil {
+		return nil, err
+	}
+	options := optionsTo(passage)
+	links := make([]string, 0)
+	for _, name := range names {
+		text, err := readPassage(srcdir, name)
+		if err != nil {
+			return nil, err
+		}
+		if options.MatchString(text) {
+			links = append(links, name)
+		}
+	}
+	return links, nil
+}
+
+// renamePassage renames the file of a passage and rewrites the options to
+// it in every passage, returning the passages rewritten.
+func renamePassage(srcdir string, from string, to string) ([]string, error) {
+	if err := checkPassageName(from); err != nil {
+		return nil, err
+	}
+	if err := checkNewPassageName(to); err != nil {
+		return nil, err
+	}
+	fromFile := path.Join(srcdir, from + ".txt")
+	toFile := path.Join(srcdir, to + ".txt")
+	fromInfo, err := os.Stat(fromFile)
+	if err != nil {
+		return nil, err
+	}
+	// On case-insensitive file systems, a change of case is the same file.
+	if toInfo, err := os.Stat(toFile); err == nil && !os.SameFile(fromInfo, toInfo) {
+		return nil, os.ErrExist
+	}
+	if err := os.Rename(fromFile, toFile); err != nil {
+		return nil, err
+	}
+	links, err := linksTo(srcdir, from)
+	if err != nil {
+		return nil, err
+	}
+	options := optionsTo(from)
+	for _, name := range links {
+		text, err := readPassage(srcdir, name)
+		if err != nil {
+			return links, err
+		}
+		text = options.ReplaceAllStringFunc(text, func(option string) string {
+			return options.FindStringSubmatch(option)[1] + "\"" + to + "\""
+		})
+		if err := writePassage(srcdir, name, text); err != nil {
+			return links, err
+		}
+	}
+	return links, nil
 }
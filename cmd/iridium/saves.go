@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+)
+
+// Games played with iridium run are saved as JSON in the saves folder of
+// the game, one file per slot.
+
+const defaultSlot = "default"
+
+var slotName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type savedStep struct {
+	Passage string `json:"passage"`
+	State State `json:"state"`
+}
+
+type savedGame struct {
+	Passage string `json:"passage"`
+	State State `json:"state"`
+	History []savedStep `json:"history"`
+}
+
+func slotFile(srcdir string, slot string) (string, error) {
+	if !slotName.MatchString(slot) {
+		return "", fmt.Errorf("bad slot name %s, use letters, digits, - and _", slot)
+	}
+	return path.Join(srcdir, SRC_SAVES, slot + ".json"), nil
+}
+
+func (p *player) save(srcdir string, slot string) (string, error) {
+	file, err := slotFile(srcdir, slot)
+	if err != nil {
+		return "", err
+	}
+	history := p.history
+	if history == nil {
+		history = []savedStep{}
+	}
+	content, err := json.MarshalIndent(savedGame{p.passage, p.state, history}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(path.Join(srcdir, SRC_SAVES), 0755); err != nil {
+		return "", err
+	}
+	return file, ioutil.WriteFile(file, content, 0644)
+}
+
+func (p *player) restore(srcdir string, slot string) error {
+	file, err := slotFile(srcdir, slot)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var saved savedGame
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	if _, err := os.Stat(path.Join(p.passagesDir, saved.Passage + ".txt")); err != nil {
+		return fmt.Errorf("%s: no passage %s", file, saved.Passage)
+	}
+	if saved.State == nil {
+		saved.State = State{}
+	}
+	p.passage = saved.Passage
+	p.state = saved.State
+	p.history = saved.History
+	return nil
+}
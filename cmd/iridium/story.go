@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path"
+)
+
+// Story is a game with all of its passages parsed, for the commands that
+// look at the whole story at once rather than one passage at a time.
+type Story struct {
+	Config GameConfig
+	Names []string
+	Passages map[string]*Passage
+	// Passages that failed to parse are left out of Passages.
+	Errors ParseErrors
+	Warnings ParseErrors
+}
+
+func loadStory(srcdir string) (*Story, error) {
+	config, err := readConfig(srcdir)
+	if err != nil {
+		return nil, err
+	}
+	passagesDir := path.Join(srcdir, SRC_PASSAGES)
+	names, err := getPassageNames(passagesDir)
+	if err != nil {
+		return nil, err
+	}
+	story := &Story{Config: config, Names: names, Passages: make(map[string]*Passage)}
+	for _, name := range names {
+		psg, warnings, err := parsePassageWarnings(passagesDir, name)
+		story.Warnings = append(story.Warnings, warnings...)
+		if errs, ok := err.(ParseErrors); ok {
+			story.Errors = append(story.Errors, errs...)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		story.Passages[name] = psg
+	}
+	return story, nil
+}
+
+// passageFile is the file of a passage, for reporting.
+func (s *Story) passageFile(srcdir string, name string) string {
+	return path.Join(srcdir, SRC_PASSAGES, name + ".txt")
+}
+
+// has reports whether the story has a passage called name, even one that
+// failed to parse.
+func (s *Story) has(name string) bool {
+	for _, n := range s.Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reachable returns the passages that can be reached from the initial
+// passage by following options, ignoring their conditions.
+func (s *Story) reachable() map[string]bool {
+	seen := make(map[string]bool)
+	queue := []string{s.Config.InitialPassage}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		psg, ok := s.Passages[name]
+		if seen[name] || !ok {
+			continue
+		}
+		seen[name] = true
+		for _, option := range psg.Options {
+			queue = append(queue, option.Target)
+		}
+	}
+	return seen
+}
+
+// walkBlocks calls f on every block, including those inside conditionals.
+func walkBlocks(blocks []Block, f func(*Block)) {
+	for i := range blocks {
+		f(&blocks[i])
+		walkBlocks(blocks[i].Then, f)
+		walkBlocks(blocks[i].Else, f)
+	}
+}
+
+// plainText renders text without markup, for listings and reports.
+// Interpolations are shown as written.
+func plainText(items []Text) string {
+	result := ""
+	for i, item := range items {
+		if i > 0 && !item.Glued {
+			result += " "
+		}
+		switch item.Kind {
+		case TEXT_WORD:
+			result += item.Word
+		case TEXT_QUOTE:
+			result += "\"" + plainText(item.Content) + "\""
+		case TEXT_EMPH, TEXT_STRONG:
+			result += plainText(item.Content)
+		case TEXT_SHOW:
+			result += "(+show " + item.Expr.String() + ")"
+		}
+	}
+	return result
+}
@@ -4,6 +4,8 @@ import (
    "os"
    "fmt"
    "io"
+   "io/ioutil"
+   "path/filepath"
 )
 
 func copy(src, dst string) (int64, error) {
@@ -28,3 +30,32 @@ func copy(src, dst string) (int64, error) {
         return nBytes, err
 }
 
+
+// writeFileAtomic writes a file through a temporary file renamed over it,
+// so that readers see either the old content or the new, never part of
+// it. The temporary file is hidden, for the dev server to ignore.
+func writeFileAtomic(file string, content []byte, perm os.FileMode) error {
+        if info, err := os.Stat(file); err == nil {
+                perm = info.Mode().Perm()
+        }
+        tmp, err := ioutil.TempFile(filepath.Dir(file), "." + filepath.Base(file) + ".tmp")
+        if err != nil {
+                return err
+        }
+        defer os.Remove(tmp.Name())
+        if _, err := tmp.Write(content); err != nil {
+                tmp.Close()
+                return err
+        }
+        if err := tmp.Sync(); err != nil {
+                tmp.Close()
+                return err
+        }
+        if err := tmp.Close(); err != nil {
+                return err
+        }
+        if err := os.Chmod(tmp.Name(), perm); err != nil {
+                return err
+        }
+        return os.Rename(tmp.Name(), file)
+}